@@ -0,0 +1,60 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+func yesNo(b bool) string {
+	if b {
+		return "yes"
+	}
+	return "no"
+}
+
+// printAccount reports who the configured ARL belongs to and what the
+// account is allowed to stream, so that an expired ARL or a non-HiFi offer
+// can be told apart from tracks that are genuinely unavailable.
+func printAccount(config configuration) {
+	ping, err := getPing(config)
+	if err != nil {
+		log.Fatalf("error pinging Deezer: %s\n", err)
+	}
+	if ping.Results.UserId == 0 {
+		log.Fatalln("The ARL in the config file has expired or is invalid. Copy a fresh value from the 'arl' cookie in your browser.")
+	}
+
+	userData, err := getUserData(config)
+	if err != nil {
+		log.Fatalf("error getting user data: %s\n", err)
+	}
+	user := userData.Results.User
+	if user.UserId == 0 {
+		log.Fatalln("The ARL in the config file has expired or is invalid. Copy a fresh value from the 'arl' cookie in your browser.")
+	}
+
+	country := user.Options.LicenseCountry
+	if country == "" {
+		country = userData.Results.Country
+	}
+
+	log.Printf("User:                    %s (%d)\n", user.BlogName, user.UserId)
+	log.Printf("Country:                 %s\n", country)
+	log.Printf("Subscription:            %s\n", userData.Results.OfferName)
+	if user.Options.ExpirationTimestamp > 0 {
+		expires := time.Unix(user.Options.ExpirationTimestamp, 0)
+		log.Printf("Subscription expires:    %s\n", expires.Format("2006-01-02"))
+	}
+	log.Printf("Lossless (FLAC):         %s\n", yesNo(user.Options.WebLossless || user.Options.MobileLossless))
+	log.Printf("High quality (MP3 320):  %s\n", yesNo(user.Options.WebHq || user.Options.MobileHq))
+
+	if !user.Options.WebLossless && !user.Options.MobileLossless {
+		log.Println("")
+		log.Println("This account cannot stream FLAC; downloads will fall back to MP3.")
+	}
+	if user.Options.LicenseToken != "" && user.Options.LicenseToken != config.LicenseToken {
+		log.Println("")
+		log.Println("The 'license_token' in the config file differs from the account's current one:")
+		log.Printf("\t%s\n", user.Options.LicenseToken)
+	}
+}
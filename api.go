@@ -11,11 +11,56 @@ import (
 	"strings"
 )
 
+// favoritesPageSize is how many tracks getFavorites asks for per page.
+const favoritesPageSize = 1000
+
+// getFavorites lists a user's favorite tracks, following the API's next
+// links across pages.
 func getFavorites(userId string, config configuration) (resTracks, error) {
-	url := fmt.Sprintf("https://api.deezer.com/user/%s/tracks?limit=10000000000", userId)
+	var tracks resTracks
+	url := fmt.Sprintf("https://api.deezer.com/user/%s/tracks?limit=%d", userId, favoritesPageSize)
+	for url != "" {
+		res, err := makeReq("GET", url, nil, config)
+		if err != nil {
+			return resTracks{}, err
+		}
+
+		if res.StatusCode != 200 {
+			bytes, _ := io.ReadAll(res.Body)
+			res.Body.Close()
+			bstr := string(bytes)
+			if len(bstr) > 200 {
+				bstr = bstr[:200] + "..."
+			}
+			log.Printf("non-200 response body (truncated): %s", bstr)
+			return resTracks{}, fmt.Errorf("got status code %d", res.StatusCode)
+		}
+
+		var page resTracks
+		err = decodeApiResponse(res.Body, &page)
+		res.Body.Close()
+		if err != nil {
+			return resTracks{}, err
+		}
+
+		tracks.Data = append(tracks.Data, page.Data...)
+		if page.Total > 0 {
+			tracks.Total = page.Total
+		}
+		if len(page.Data) == 0 {
+			break
+		}
+		url = page.Next
+	}
+	return tracks, nil
+}
+
+// getTrackByIsrc looks a track up by its ISRC.
+func getTrackByIsrc(isrc string, config configuration) (resTrack, error) {
+	url := fmt.Sprintf("https://api.deezer.com/track/isrc:%s", isrc)
 	res, err := makeReq("GET", url, nil, config)
 	if err != nil {
-		return resTracks{}, err
+		return resTrack{}, err
 	}
 	defer res.Body.Close()
 
@@ -26,12 +71,12 @@ func getFavorites(userId string, config configuration) (resTracks, error) {
 			bstr = bstr[:200] + "..."
 		}
 		log.Printf("non-200 response body (truncated): %s", bstr)
-		return resTracks{}, fmt.Errorf("got status code %d", res.StatusCode)
+		return resTrack{}, fmt.Errorf("got status code %d", res.StatusCode)
 	}
 
-	var tracks resTracks
-	err = json.NewDecoder(res.Body).Decode(&tracks)
-	return tracks, err
+	var track resTrack
+	err = decodeApiResponse(res.Body, &track)
+	return track, err
 }
 
 func getSongInfo(id int64, config configuration) (resSongInfo, error) {
@@ -59,7 +104,13 @@ func getSongInfo(id int64, config configuration) (resSongInfo, error) {
 	startMarker := `window.__DZR_APP_STATE__ = `
 	endMarker := `</script>`
 	startIdx := strings.Index(s, startMarker)
+	if startIdx < 0 {
+		return resSongInfo{}, fmt.Errorf("could not find app state in song page")
+	}
 	endIdx := strings.Index(s[startIdx:], endMarker)
+	if endIdx < 0 {
+		return resSongInfo{}, fmt.Errorf("could not find script end in song page")
+	}
 	sData := s[startIdx+len(startMarker) : startIdx+endIdx]
 
 	var songInfo resSongInfo
@@ -86,10 +137,12 @@ func getAlbum(albumId string, config configuration) (resAlbum, error) {
 	}
 
 	var album resAlbum
-	err = json.NewDecoder(res.Body).Decode(&album)
+	err = decodeApiResponse(res.Body, &album)
 	return album, err
 }
 
+const albumSongsPageSize = 500
+
 func getAlbumSongs(albumId string, config configuration) (resAlbumInfo, error) {
 	url := fmt.Sprintf("https://www.deezer.com/de/album/%s", albumId)
 
@@ -115,12 +168,41 @@ func getAlbumSongs(albumId string, config configuration) (resAlbumInfo, error) {
 	startMarker := `window.__DZR_APP_STATE__ = `
 	endMarker := `</script>`
 	startIdx := strings.Index(s, startMarker)
+	if startIdx < 0 {
+		return resAlbumInfo{}, fmt.Errorf("could not find app state in album page")
+	}
 	endIdx := strings.Index(s[startIdx:], endMarker)
+	if endIdx < 0 {
+		return resAlbumInfo{}, fmt.Errorf("could not find script end in album page")
+	}
 	sData := s[startIdx+len(startMarker) : startIdx+endIdx]
 
 	var albumInfo resAlbumInfo
 	err = json.NewDecoder(strings.NewReader(sData)).Decode(&albumInfo)
 	// Ignore error, because we're only unmarshaling SONGS
+
+	// The page only embeds the first batch of songs; fetch the rest
+	for len(albumInfo.Songs.Data) < albumInfo.Songs.Total {
+		var page resAlbumSongs
+		params := map[string]interface{}{
+			"alb_id": albumId,
+			"start":  len(albumInfo.Songs.Data),
+			"nb":     albumSongsPageSize,
+		}
+		err = callGwLight("song.getListByAlbum", params, &page, config)
+		if err != nil {
+			log.Printf("could not page through album songs: %v\n", err)
+			break
+		}
+		if len(page.Data) == 0 {
+			break
+		}
+		albumInfo.Songs.Data = append(albumInfo.Songs.Data, page.Data...)
+		if page.FilteredCount > albumInfo.Songs.FilteredCount {
+			albumInfo.Songs.FilteredCount = page.FilteredCount
+		}
+	}
+	albumInfo.Songs.Count = len(albumInfo.Songs.Data)
 	return albumInfo, nil
 }
 
@@ -136,13 +218,33 @@ func getPlaylist(playlistId string, config configuration) (resPlaylist, error) {
 	defer res.Body.Close()
 
 	if res.StatusCode == 200 {
-		bodyBytes, _ := io.ReadAll(res.Body)
-		if err := json.NewDecoder(bytes.NewReader(bodyBytes)).Decode(&playlist); err == nil {
-			// if API returned tracks, return it
-			if playlist.Tracks.Total > 0 || len(playlist.Tracks.Data) > 0 {
-				return playlist, nil
+		// Quota, not found and region-locked errors are final. The license
+		// token is not an OAuth token, so an auth error may only mean the API
+		// rejected it: the web page, which uses the ARL, is tried instead
+		err := decodeApiResponse(res.Body, &playlist)
+		var ae authError
+		if errors.As(err, &ae) {
+			log.Printf("playlist API refused the request, reading the page instead: %v\n", err)
+			playlist = resPlaylist{}
+		} else if err != nil {
+			return resPlaylist{}, err
+		}
+		// The embedded track list is capped, so page through the rest
+		if len(playlist.Tracks.Data) < playlist.NbTracks {
+			tracks, err := getPlaylistTracks(playlistId, config)
+			if err != nil {
+				log.Printf("could not page through playlist tracks: %v\n", err)
+			} else if len(tracks.Data) > len(playlist.Tracks.Data) {
+				playlist.Tracks = tracks
 			}
 		}
+		if playlist.Tracks.Total == 0 {
+			playlist.Tracks.Total = playlist.NbTracks
+		}
+		// if API returned tracks, return it
+		if playlist.Tracks.Total > 0 || len(playlist.Tracks.Data) > 0 {
+			return playlist, nil
+		}
 		// fall through to webpage parsing below
 	}
 	// Fallback: fetch playlist page like albums to reuse ARL cookie and parsing
@@ -229,7 +331,97 @@ func getPlaylist(playlistId string, config configuration) (resPlaylist, error) {
 	return playlist, nil
 }
 
-// getPlaylistSongs parses the public playlist page and extracts track list
+const playlistPageSize = 1000
+
+// getPlaylistTracks pages through the API's playlist track list, following
+// the next links until every track has been fetched.
+func getPlaylistTracks(playlistId string, config configuration) (resTracks, error) {
+	var tracks resTracks
+	url := fmt.Sprintf("https://api.deezer.com/playlist/%s/tracks?limit=%d&access_token=%s",
+		playlistId, playlistPageSize, config.LicenseToken)
+	for url != "" {
+		res, err := makeReq("GET", url, nil, config)
+		if err != nil {
+			return resTracks{}, err
+		}
+
+		if res.StatusCode != 200 {
+			bytes, _ := io.ReadAll(res.Body)
+			res.Body.Close()
+			bstr := string(bytes)
+			if len(bstr) > 200 {
+				bstr = bstr[:200] + "..."
+			}
+			log.Printf("non-200 playlist tracks response (truncated): %s", bstr)
+			return resTracks{}, fmt.Errorf("got status code %d", res.StatusCode)
+		}
+
+		var page resTracks
+		err = decodeApiResponse(res.Body, &page)
+		res.Body.Close()
+		if err != nil {
+			return resTracks{}, err
+		}
+
+		tracks.Data = append(tracks.Data, page.Data...)
+		if page.Total > 0 {
+			tracks.Total = page.Total
+		}
+		if len(page.Data) == 0 {
+			break
+		}
+		url = page.Next
+	}
+	return tracks, nil
+}
+
+// artistAlbumsPageSize is how many albums getArtistAlbums asks for per page.
+const artistAlbumsPageSize = 100
+
+// getArtistAlbums lists every album of an artist, following the API's next
+// links across pages.
+func getArtistAlbums(artistId string, config configuration) (resArtistAlbums, error) {
+	var albums resArtistAlbums
+	url := fmt.Sprintf("https://api.deezer.com/artist/%s/albums?limit=%d", artistId, artistAlbumsPageSize)
+	for url != "" {
+		res, err := makeReq("GET", url, nil, config)
+		if err != nil {
+			return resArtistAlbums{}, err
+		}
+
+		if res.StatusCode != 200 {
+			bytes, _ := io.ReadAll(res.Body)
+			res.Body.Close()
+			bstr := string(bytes)
+			if len(bstr) > 200 {
+				bstr = bstr[:200] + "..."
+			}
+			log.Printf("non-200 artist albums response (truncated): %s", bstr)
+			return resArtistAlbums{}, fmt.Errorf("got status code %d", res.StatusCode)
+		}
+
+		var page resArtistAlbums
+		err = decodeApiResponse(res.Body, &page)
+		res.Body.Close()
+		if err != nil {
+			return resArtistAlbums{}, err
+		}
+
+		albums.Data = append(albums.Data, page.Data...)
+		if page.Total > 0 {
+			albums.Total = page.Total
+		}
+		if len(page.Data) == 0 {
+			break
+		}
+		url = page.Next
+	}
+	return albums, nil
+}
+
+// getPlaylistSongs parses the public playlist page and extracts track list.
+// The page only carries the first batch of tracks; the declared total is
+// returned alongside so callers can tell when the list is incomplete.
 func getPlaylistSongs(playlistId string, config configuration) (resTracks, error) {
 	url := fmt.Sprintf("https://www.deezer.com/playlist/%s", playlistId)
 	res, err := makeReq("GET", url, nil, config)
@@ -270,10 +462,23 @@ func getPlaylistSongs(playlistId string, config configuration) (resTracks, error
 
 	// recursive search for an array of track-like objects
 	var found []interface{}
+	declaredTotal := 0
 	var walk func(interface{}) bool
 	walk = func(n interface{}) bool {
 		switch v := n.(type) {
 		case map[string]interface{}:
+			// a {"data": [...], "total": N} block tells us the full length
+			if data, ok := v["data"].([]interface{}); ok && len(data) > 0 {
+				if first, ok2 := data[0].(map[string]interface{}); ok2 {
+					if _, hasSng := first["SNG_ID"]; hasSng {
+						found = data
+						if total, ok3 := v["total"].(float64); ok3 {
+							declaredTotal = int(total)
+						}
+						return true
+					}
+				}
+			}
 			for _, val := range v {
 				if walk(val) {
 					return true
@@ -426,7 +631,11 @@ func getPlaylistSongs(playlistId string, config configuration) (resTracks, error
 		tracks = append(tracks, t)
 	}
 
-	return resTracks{Data: tracks, Total: len(tracks)}, nil
+	total := len(tracks)
+	if declaredTotal > total {
+		total = declaredTotal
+	}
+	return resTracks{Data: tracks, Total: total}, nil
 }
 
 func getSongUrlData(trackToken string, format string, config configuration) (resSongUrl, error) {
@@ -489,6 +698,129 @@ func getPing(config configuration) (resPing, error) {
 	return ping, err
 }
 
+// getUserData fetches the account details and streaming rights attached to
+// the configured ARL.
+func getUserData(config configuration) (resUserData, error) {
+	url := "https://www.deezer.com/ajax/gw-light.php?method=deezer.getUserData&input=3&api_version=1.0&api_token="
+	res, err := makeReq("GET", url, nil, config)
+	if err != nil {
+		return resUserData{}, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != 200 {
+		bytes, _ := io.ReadAll(res.Body)
+		bstr := string(bytes)
+		if len(bstr) > 200 {
+			bstr = bstr[:200] + "..."
+		}
+		log.Printf("non-200 user data response (truncated): %s", bstr)
+		return resUserData{}, fmt.Errorf("got status code %d", res.StatusCode)
+	}
+
+	var userData resUserData
+	err = json.NewDecoder(res.Body).Decode(&userData)
+	return userData, err
+}
+
+var gwApiToken string
+
+// errGwTokenExpired is returned by gwLightRequest when Deezer rejects the
+// cached api_token, which happens once the session it belongs to expires.
+var errGwTokenExpired = errors.New("gw-light api token expired")
+
+// callGwLight invokes a gw-light method that requires an api_token and
+// decodes its "results" object into result. A rejected token is fetched
+// again and the call retried once.
+func callGwLight(method string, params interface{}, result interface{}, config configuration) error {
+	err := gwLightRequest(method, params, result, config)
+	if errors.Is(err, errGwTokenExpired) {
+		gwApiToken = ""
+		err = gwLightRequest(method, params, result, config)
+	}
+	return err
+}
+
+func gwLightRequest(method string, params interface{}, result interface{}, config configuration) error {
+	if gwApiToken == "" {
+		userData, err := getUserData(config)
+		if err != nil {
+			return err
+		}
+		if userData.Results.CheckForm == "" {
+			return errors.New("could not obtain a gw-light api token; is the ARL still valid?")
+		}
+		gwApiToken = userData.Results.CheckForm
+	}
+
+	body, err := json.Marshal(params)
+	if err != nil {
+		return err
+	}
+	url := fmt.Sprintf("https://www.deezer.com/ajax/gw-light.php?method=%s&input=3&api_version=1.0&api_token=%s",
+		method, gwApiToken)
+	res, err := makeReq("POST", url, bytes.NewReader(body), config)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != 200 {
+		bytes, _ := io.ReadAll(res.Body)
+		bstr := string(bytes)
+		if len(bstr) > 200 {
+			bstr = bstr[:200] + "..."
+		}
+		log.Printf("non-200 %s response (truncated): %s", method, bstr)
+		return fmt.Errorf("got status code %d", res.StatusCode)
+	}
+
+	var envelope struct {
+		Error   interface{}     `json:"error"`
+		Results json.RawMessage `json:"results"`
+	}
+	err = json.NewDecoder(res.Body).Decode(&envelope)
+	if err != nil {
+		return err
+	}
+	switch e := envelope.Error.(type) {
+	case map[string]interface{}:
+		if isGwTokenError(e) {
+			return fmt.Errorf("%s failed: %w", method, errGwTokenExpired)
+		}
+		if len(e) > 0 {
+			return fmt.Errorf("%s failed: %v", method, e)
+		}
+	case []interface{}:
+		if len(e) > 0 {
+			return fmt.Errorf("%s failed: %v", method, e)
+		}
+	}
+	return json.Unmarshal(envelope.Results, result)
+}
+
+// isGwTokenError reports whether a gw-light error object says the api_token
+// is missing or invalid, e.g. {"VALID_TOKEN_REQUIRED": "Invalid CSRF token"}.
+func isGwTokenError(e map[string]interface{}) bool {
+	for key, value := range e {
+		if key == "VALID_TOKEN_REQUIRED" {
+			return true
+		}
+		msg, _ := value.(string)
+		if strings.Contains(strings.ToLower(msg), "csrf") {
+			return true
+		}
+	}
+	return false
+}
+
+// getLyrics fetches the plain and time-synced lyrics of a song.
+func getLyrics(songId string, config configuration) (resLyrics, error) {
+	var lyrics resLyrics
+	err := callGwLight("song.getLyrics", map[string]string{"sng_id": songId}, &lyrics, config)
+	return lyrics, err
+}
+
 func getSongUrl(songUrlData resSongUrl) (string, error) {
 	if len(songUrlData.Data) == 0 || len(songUrlData.Data[0].Media) == 0 {
 		return "", errors.New("no media available in songUrlData")
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"os"
+	"time"
+)
+
+// httpClient carries every request the program makes. It keeps the session
+// cookies Deezer hands out so that gw-light calls made with an api_token stay
+// on the session the token belongs to.
+var httpClient = &http.Client{}
+
+// newHttpClient builds a client with the proxy, timeouts, connection pool and
+// CA bundle from the [http] section of the config.
+func newHttpClient(config httpConfig) (*http.Client, error) {
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		return nil, err
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+
+	if config.Proxy != "" {
+		proxyUrl, err := url.Parse(config.Proxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy %q: %w", config.Proxy, err)
+		}
+		switch proxyUrl.Scheme {
+		case "http", "https", "socks5":
+		default:
+			return nil, fmt.Errorf("unsupported proxy scheme %q, use http, https or socks5", proxyUrl.Scheme)
+		}
+		transport.Proxy = http.ProxyURL(proxyUrl)
+	}
+
+	// The timeout bounds connecting and waiting for a response, not reading
+	// the body, so that large downloads are not cut off halfway.
+	if config.TimeoutSeconds > 0 {
+		timeout := time.Duration(config.TimeoutSeconds * float64(time.Second))
+		transport.DialContext = (&net.Dialer{
+			Timeout:   timeout,
+			KeepAlive: 30 * time.Second,
+		}).DialContext
+		transport.TLSHandshakeTimeout = timeout
+		transport.ResponseHeaderTimeout = timeout
+	}
+	if config.IdleTimeoutSeconds > 0 {
+		transport.IdleConnTimeout = time.Duration(config.IdleTimeoutSeconds * float64(time.Second))
+	}
+	if config.MaxConnsPerHost > 0 {
+		transport.MaxConnsPerHost = config.MaxConnsPerHost
+		transport.MaxIdleConnsPerHost = config.MaxConnsPerHost
+	}
+
+	if config.CaBundle != "" {
+		pem, err := os.ReadFile(config.CaBundle)
+		if err != nil {
+			return nil, fmt.Errorf("error reading CA bundle: %w", err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in CA bundle %s", config.CaBundle)
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	}
+
+	return &http.Client{Jar: jar, Transport: transport}, nil
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"errors"
+	"fmt"
 	"os"
 
 	"github.com/BurntSushi/toml"
@@ -11,6 +12,30 @@ func getConfig() (configuration, error) {
 	var err error
 	var config configuration
 
+	// Deezer documents a public API quota of 50 requests per 5 seconds
+	config.RateLimit = rateLimitConfig{
+		Requests:         50,
+		WindowSeconds:    5,
+		CdnRequests:      0,
+		CdnWindowSeconds: 1,
+	}
+	config.Http = httpConfig{
+		TimeoutSeconds:     30,
+		IdleTimeoutSeconds: 90,
+	}
+	config.AlbumPathTemplate = defaultPathTemplate
+	config.PlaylistPathTemplate = defaultPathTemplate
+	config.CompilationsDir = defaultCompilationsDir
+	config.CompilationPathTemplate = defaultCompilationPathTemplate
+	config.PlaylistMode = playlistModeAlbum
+	config.PlaylistsDir = defaultPlaylistsDir
+	config.PlaylistFolderTemplate = defaultPlaylistFolderTemplate
+	config.SyncRemoved = syncRemovedKeep
+	config.ArchiveDir = defaultArchiveDir
+	config.Watch = watchConfig{IntervalMinutes: 60}
+	config.MultiDisc = multiDiscFolder
+	config.MaxNameBytes = defaultMaxNameBytes
+
 	configDir := os.Getenv("XDG_CONFIG_HOME")
 	if len(configDir) == 0 {
 		homedir, err := os.UserHomeDir()
@@ -40,5 +65,37 @@ func getConfig() (configuration, error) {
 	if len(config.Iv) == 0 {
 		return configuration{}, errors.New("please provide a value for the 'iv' field in the config file")
 	}
+	if err := checkPathTemplate(config.AlbumPathTemplate); err != nil {
+		return configuration{}, fmt.Errorf("invalid 'album_path_template': %w", err)
+	}
+	if err := checkPathTemplate(config.PlaylistPathTemplate); err != nil {
+		return configuration{}, fmt.Errorf("invalid 'playlist_path_template': %w", err)
+	}
+	if err := checkPathTemplate(config.CompilationPathTemplate); err != nil {
+		return configuration{}, fmt.Errorf("invalid 'compilation_path_template': %w", err)
+	}
+	if err := checkPathTemplate(config.PlaylistFolderTemplate); err != nil {
+		return configuration{}, fmt.Errorf("invalid 'playlist_folder_template': %w", err)
+	}
+	if config.PlaylistMode != playlistModeAlbum && config.PlaylistMode != playlistModeFolder {
+		return configuration{}, fmt.Errorf("invalid 'playlist_mode' %q: use \"album\" or \"folder\"", config.PlaylistMode)
+	}
+	if err := checkSyncRemoved(config.SyncRemoved); err != nil {
+		return configuration{}, fmt.Errorf("invalid 'sync_removed': %w", err)
+	}
+	if config.Watch.IntervalMinutes <= 0 {
+		return configuration{}, errors.New("'interval_minutes' in [watch] must be positive")
+	}
+	switch config.Lyrics {
+	case "", lyricsSidecar, lyricsEmbedded, lyricsBoth:
+	default:
+		return configuration{}, fmt.Errorf("invalid 'lyrics' %q: use \"sidecar\", \"embedded\" or \"both\"", config.Lyrics)
+	}
+	if config.MultiDisc != multiDiscFolder && config.MultiDisc != multiDiscPrefix {
+		return configuration{}, fmt.Errorf("invalid 'multi_disc' %q: use \"folder\" or \"prefix\"", config.MultiDisc)
+	}
+	if config.MaxNameBytes < 2*fileNameReserve {
+		return configuration{}, fmt.Errorf("'max_name_bytes' must be at least %d", 2*fileNameReserve)
+	}
 	return config, nil
 }
@@ -8,7 +8,6 @@ import (
 	"fmt"
 	"io"
 	"log"
-	"net/http"
 	"os"
 	"path"
 	"time"
@@ -58,21 +57,7 @@ func ensureSongDirectoryExists(songPath string, coverUrl string) error {
 		if len(coverUrl) == 0 {
 			log.Println("Skipping cover")
 		} else {
-			coverFilePath := songDir + "/cover.jpg"
-			f, err := os.Create(coverFilePath)
-			if err != nil {
-				return err
-			}
-			defer f.Close()
-			res, err := http.Get(coverUrl)
-			if err != nil {
-				return err
-			}
-			defer res.Body.Close()
-			if res.StatusCode != 200 {
-				return fmt.Errorf("error downloading cover: status %d", res.StatusCode)
-			}
-			_, err = io.Copy(f, res.Body)
+			err = downloadCover(coverUrl, songDir+"/cover.jpg")
 			if err != nil {
 				return err
 			}
@@ -81,7 +66,25 @@ func ensureSongDirectoryExists(songPath string, coverUrl string) error {
 	return nil
 }
 
-func downloadSong(url string, songPath string, songId string, attempt int, config configuration) error {
+func downloadCover(coverUrl string, coverFilePath string) error {
+	f, err := os.Create(coverFilePath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	res, err := httpClient.Get(coverUrl)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		return fmt.Errorf("error downloading cover: status %d", res.StatusCode)
+	}
+	_, err = io.Copy(f, res.Body)
+	return err
+}
+
+func downloadSong(url string, songPath string, songId string, attempt int, config configuration, progress *trackProgress) error {
 	var err error
 
 	if attempt >= 10 {
@@ -93,6 +96,7 @@ func downloadSong(url string, songPath string, songId string, attempt int, confi
 		return err
 	}
 	defer f.Close()
+	progress.restart()
 
 	res, err := makeReq("GET", url, nil, config)
 	if err != nil {
@@ -110,6 +114,11 @@ func downloadSong(url string, songPath string, songId string, attempt int, confi
 		return fmt.Errorf("got status code %d", res.StatusCode)
 	}
 
+	var body io.Reader = res.Body
+	if bandwidthLimiter != nil {
+		body = throttledReader{r: res.Body, limiter: bandwidthLimiter}
+	}
+
 	bfKey := calcBfKey([]byte(songId), config)
 
 	// One in every third 2048 byte block is encrypted
@@ -124,7 +133,7 @@ outer_loop:
 	for {
 		nRead = 0
 		for nRead < blockSize {
-			nNewRead, err := res.Body.Read(buf[nRead:])
+			nNewRead, err := body.Read(buf[nRead:])
 			nRead += nNewRead
 			totalBytes += nNewRead
 			if breakNextTime {
@@ -138,7 +147,7 @@ outer_loop:
 				log.Printf("Error reading body on i=%d: %s\n", i, err)
 				log.Println("Retrying")
 				time.Sleep(500 * time.Millisecond)
-				return downloadSong(url, songPath, songId, attempt+1, config)
+				return downloadSong(url, songPath, songId, attempt+1, config, progress)
 			}
 		}
 
@@ -154,10 +163,12 @@ outer_loop:
 		} else {
 			f.Write(buf[:nRead])
 		}
+		progress.add(nRead)
 
 		i += 1
 	}
 
+	progress.clear()
 	log.Printf("Wrote %d bytes: %s", totalBytes, songPath)
 
 	return nil
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"time"
+)
+
+// apiError is the envelope api.deezer.com sends, with HTTP status 200, when a
+// request fails, e.g. {"error":{"type":"DataException","message":"no data","code":800}}.
+type apiError struct {
+	Type    string `json:"type"`
+	Message string `json:"message"`
+	Code    int    `json:"code"`
+}
+
+func (e apiError) Error() string {
+	return fmt.Sprintf("deezer API error %d (%s): %s", e.Code, e.Type, e.Message)
+}
+
+// quotaError means the request quota was exceeded or the service is busy;
+// the request can be retried after backing off.
+type quotaError struct{ apiError }
+
+// notFoundError means the requested object does not exist.
+type notFoundError struct{ apiError }
+
+// authError means the ARL, license token or account type was rejected.
+type authError struct{ apiError }
+
+// geoError means the object exists but is not available in the account's country.
+type geoError struct{ apiError }
+
+func classifyApiError(e apiError) error {
+	message := strings.ToLower(e.Message)
+	switch {
+	case e.Code == 4 || e.Code == 700:
+		return quotaError{e}
+	case strings.Contains(message, "country") || strings.Contains(message, "region"):
+		return geoError{e}
+	case e.Code == 800:
+		return notFoundError{e}
+	case e.Code == 200 || e.Code == 300 || e.Code == 901 || e.Type == "OAuthException":
+		return authError{e}
+	}
+	return e
+}
+
+// decodeApiResponse decodes an api.deezer.com response body into v, turning
+// an error envelope into one of the error types above. A quota error also
+// pauses the API's rate limiter for a full window.
+func decodeApiResponse(r io.Reader, v interface{}) error {
+	body, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	var envelope struct {
+		Error *apiError `json:"error"`
+	}
+	if json.Unmarshal(body, &envelope) == nil && envelope.Error != nil &&
+		(envelope.Error.Code != 0 || envelope.Error.Type != "") {
+		err = classifyApiError(*envelope.Error)
+		var qe quotaError
+		if errors.As(err, &qe) {
+			pauseHost("api.deezer.com")
+		}
+		return err
+	}
+	return json.Unmarshal(body, v)
+}
+
+// isUnavailable reports whether err means the object cannot be fetched at
+// all, so the caller should skip it rather than abort.
+func isUnavailable(err error) bool {
+	var nf notFoundError
+	var geo geoError
+	return errors.As(err, &nf) || errors.As(err, &geo)
+}
+
+const maxQuotaRetries = 5
+
+var quotaBackoff = 5 * time.Second
+
+// retryOnQuota runs fn again, waiting a little longer each time, for as long
+// as the API reports that the request quota is exceeded.
+func retryOnQuota(fn func() error) error {
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		var qe quotaError
+		if !errors.As(err, &qe) || attempt >= maxQuotaRetries {
+			return err
+		}
+		wait := time.Duration(attempt) * quotaBackoff
+		log.Printf("Deezer API quota exceeded, waiting %s\n", wait)
+		time.Sleep(wait)
+	}
+}
+
+// errorHint returns advice to print alongside err, if there is any.
+func errorHint(err error) string {
+	var ae authError
+	if errors.As(err, &ae) {
+		return " (check the ARL and license token with the whoami command)"
+	}
+	return ""
+}
@@ -9,6 +9,5 @@ require (
 	github.com/go-flac/flacvorbis v0.1.0
 	github.com/go-flac/go-flac v0.3.1
 	golang.org/x/crypto v0.1.0
+	golang.org/x/text v0.4.0
 )
-
-require golang.org/x/text v0.4.0 // indirect
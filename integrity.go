@@ -0,0 +1,210 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/go-flac/go-flac"
+)
+
+// verifyDownload checks a freshly downloaded file before it is tagged: its
+// size must match what Deezer declared, and a FLAC stream must be complete
+// down to its last frame.
+func verifyDownload(songPath string, format string, expected int64) error {
+	info, err := os.Stat(songPath)
+	if err != nil {
+		return err
+	}
+	if expected > 0 && info.Size() != expected {
+		return fmt.Errorf("size mismatch: got %d bytes, expected %d", info.Size(), expected)
+	}
+	if strings.ToUpper(format) == "FLAC" {
+		return verifyFlacStream(songPath)
+	}
+	return nil
+}
+
+// verifyFlacStream walks every frame of a FLAC file, checking each header's
+// CRC-8 and each frame's CRC-16, and compares the number of samples found
+// with the total recorded in STREAMINFO.
+func verifyFlacStream(songPath string) error {
+	f, err := flac.ParseFile(songPath)
+	if err != nil {
+		return err
+	}
+	return verifyFlacFrames(f)
+}
+
+// verifyFlacFrames is verifyFlacStream for a file that is already parsed.
+func verifyFlacFrames(f *flac.File) error {
+	streamInfo, err := f.GetStreamInfo()
+	if err != nil {
+		return err
+	}
+
+	data := f.Frames
+	var samples int64
+	pos := 0
+	for pos < len(data) {
+		blockSize, ok := parseFlacFrameHeader(data[pos:])
+		if !ok {
+			return fmt.Errorf("invalid frame header at byte %d of the audio stream", pos)
+		}
+		end := findFlacFrameEnd(data, pos)
+		if end < 0 {
+			return fmt.Errorf("corrupt or truncated frame at byte %d of the audio stream", pos)
+		}
+		samples += int64(blockSize)
+		pos = end
+	}
+
+	if samples == 0 {
+		return fmt.Errorf("no audio frames found")
+	}
+	if streamInfo.SampleCount > 0 && samples != streamInfo.SampleCount {
+		return fmt.Errorf("stream has %d samples, STREAMINFO declares %d", samples, streamInfo.SampleCount)
+	}
+	return nil
+}
+
+// findFlacFrameEnd returns the offset just past the frame starting at start:
+// the first position where a valid frame header begins, or the end of data,
+// such that the bytes before it end with a matching CRC-16. It returns -1
+// when no such position exists.
+func findFlacFrameEnd(data []byte, start int) int {
+	const minFrameSize = 10
+	var crc uint16
+	crcPos := start
+	for end := start + minFrameSize; end <= len(data); end++ {
+		if end < len(data) {
+			if data[end] != 0xFF {
+				continue
+			}
+			if _, ok := parseFlacFrameHeader(data[end:]); !ok {
+				continue
+			}
+		}
+		for ; crcPos < end-2; crcPos++ {
+			crc = crc16Table[byte(crc>>8)^data[crcPos]] ^ crc<<8
+		}
+		if crc == uint16(data[end-2])<<8|uint16(data[end-1]) {
+			return end
+		}
+	}
+	return -1
+}
+
+// parseFlacFrameHeader validates the frame header at the start of data,
+// including its CRC-8, and returns the frame's block size in samples.
+func parseFlacFrameHeader(data []byte) (int, bool) {
+	if len(data) < 6 || data[0] != 0xFF || data[1]&0xFE != 0xF8 {
+		return 0, false
+	}
+	blockSizeCode := data[2] >> 4
+	sampleRateCode := data[2] & 0x0F
+	channels := data[3] >> 4
+	sampleSizeCode := (data[3] >> 1) & 0x07
+	if blockSizeCode == 0 || sampleRateCode == 0x0F || channels > 10 ||
+		sampleSizeCode == 3 || data[3]&0x01 != 0 {
+		return 0, false
+	}
+
+	// Frame or sample number, coded like UTF-8 on up to 7 bytes
+	pos := 4
+	lead := data[pos]
+	extra := 0
+	switch {
+	case lead&0x80 == 0:
+	case lead&0xE0 == 0xC0:
+		extra = 1
+	case lead&0xF0 == 0xE0:
+		extra = 2
+	case lead&0xF8 == 0xF0:
+		extra = 3
+	case lead&0xFC == 0xF8:
+		extra = 4
+	case lead&0xFE == 0xFC:
+		extra = 5
+	case lead == 0xFE:
+		extra = 6
+	default:
+		return 0, false
+	}
+	pos++
+	for i := 0; i < extra; i++ {
+		if pos >= len(data) || data[pos]&0xC0 != 0x80 {
+			return 0, false
+		}
+		pos++
+	}
+
+	var blockSize int
+	switch {
+	case blockSizeCode == 1:
+		blockSize = 192
+	case blockSizeCode <= 5:
+		blockSize = 576 << (blockSizeCode - 2)
+	case blockSizeCode == 6:
+		if pos >= len(data) {
+			return 0, false
+		}
+		blockSize = int(data[pos]) + 1
+		pos++
+	case blockSizeCode == 7:
+		if pos+1 >= len(data) {
+			return 0, false
+		}
+		blockSize = (int(data[pos])<<8 | int(data[pos+1])) + 1
+		pos += 2
+	default:
+		blockSize = 256 << (blockSizeCode - 8)
+	}
+
+	switch sampleRateCode {
+	case 12:
+		pos++
+	case 13, 14:
+		pos += 2
+	}
+
+	if pos >= len(data) {
+		return 0, false
+	}
+	var crc uint8
+	for _, b := range data[:pos] {
+		crc = crc8Table[crc^b]
+	}
+	if crc != data[pos] {
+		return 0, false
+	}
+	return blockSize, true
+}
+
+// FLAC's frame header CRC-8 uses the polynomial x^8 + x^2 + x + 1 and its
+// frame CRC-16 the polynomial x^16 + x^15 + x^2 + 1.
+var (
+	crc8Table  [256]uint8
+	crc16Table [256]uint16
+)
+
+func init() {
+	for i := 0; i < 256; i++ {
+		c8 := uint8(i)
+		c16 := uint16(i) << 8
+		for bit := 0; bit < 8; bit++ {
+			if c8&0x80 != 0 {
+				c8 = c8<<1 ^ 0x07
+			} else {
+				c8 <<= 1
+			}
+			if c16&0x8000 != 0 {
+				c16 = c16<<1 ^ 0x8005
+			} else {
+				c16 <<= 1
+			}
+		}
+		crc8Table[i] = c8
+		crc16Table[i] = c16
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/binary"
+	"strings"
+	"testing"
+
+	"github.com/go-flac/go-flac"
+)
+
+// testFlacFrame builds a mono, 16-bit, 44.1kHz frame with an 8-bit block size
+// and the given subframe bytes, with valid CRC-8 and CRC-16.
+func testFlacFrame(number byte, blockSize int, subframe []byte) []byte {
+	frame := []byte{0xFF, 0xF8, 0x69, 0x08, number, byte(blockSize - 1)}
+	var crc8 uint8
+	for _, b := range frame {
+		crc8 = crc8Table[crc8^b]
+	}
+	frame = append(frame, crc8)
+	frame = append(frame, subframe...)
+	var crc16 uint16
+	for _, b := range frame {
+		crc16 = crc16Table[byte(crc16>>8)^b] ^ crc16<<8
+	}
+	return append(frame, byte(crc16>>8), byte(crc16))
+}
+
+// testFlacFile wraps frames in a file whose STREAMINFO declares sampleCount
+// samples.
+func testFlacFile(frames []byte, sampleCount int64) *flac.File {
+	info := make([]byte, 34)
+	binary.BigEndian.PutUint16(info[0:], 192)
+	binary.BigEndian.PutUint16(info[2:], 192)
+	binary.BigEndian.PutUint64(info[10:], 44100<<44|15<<36|uint64(sampleCount))
+	return &flac.File{
+		Meta:   []*flac.MetaDataBlock{{Type: flac.StreamInfo, Data: info}},
+		Frames: frames,
+	}
+}
+
+func testFlacStream() []byte {
+	var frames []byte
+	// Constant subframes, each holding a single 16-bit sample value
+	frames = append(frames, testFlacFrame(0, 192, []byte{0x00, 0x12, 0x34})...)
+	frames = append(frames, testFlacFrame(1, 192, []byte{0x00, 0x56, 0x78})...)
+	frames = append(frames, testFlacFrame(2, 100, []byte{0x00, 0x00, 0x00})...)
+	return frames
+}
+
+func TestFlacCrcTables(t *testing.T) {
+	var crc8 uint8
+	var crc16 uint16
+	for _, b := range []byte("123456789") {
+		crc8 = crc8Table[crc8^b]
+		crc16 = crc16Table[byte(crc16>>8)^b] ^ crc16<<8
+	}
+	if crc8 != 0xF4 {
+		t.Errorf("CRC-8 check value is %#x, want 0xf4", crc8)
+	}
+	if crc16 != 0xFEE8 {
+		t.Errorf("CRC-16 check value is %#x, want 0xfee8", crc16)
+	}
+}
+
+func TestVerifyFlacFrames(t *testing.T) {
+	if err := verifyFlacFrames(testFlacFile(testFlacStream(), 484)); err != nil {
+		t.Fatalf("valid stream: %s", err)
+	}
+	if err := verifyFlacFrames(testFlacFile(testFlacStream(), 0)); err != nil {
+		t.Errorf("stream with unknown sample count: %s", err)
+	}
+
+	err := verifyFlacFrames(testFlacFile(testFlacStream(), 500))
+	if err == nil || !strings.Contains(err.Error(), "484 samples") {
+		t.Errorf("sample count mismatch: got %v", err)
+	}
+
+	stream := testFlacStream()
+	err = verifyFlacFrames(testFlacFile(stream[:len(stream)-1], 484))
+	if err == nil {
+		t.Error("truncated stream passed")
+	}
+}
+
+func TestVerifyFlacFramesFlippedByte(t *testing.T) {
+	stream := testFlacStream()
+	for i := range stream {
+		corrupt := append([]byte(nil), stream...)
+		corrupt[i] ^= 0x01
+		if err := verifyFlacFrames(testFlacFile(corrupt, 484)); err == nil {
+			t.Errorf("stream with byte %d flipped passed", i)
+		}
+	}
+}
+
+func TestParseFlacFrameHeader(t *testing.T) {
+	frame := testFlacFrame(0, 192, []byte{0x00, 0x12, 0x34})
+	blockSize, ok := parseFlacFrameHeader(frame)
+	if !ok || blockSize != 192 {
+		t.Errorf("got block size %d, ok %v; want 192, true", blockSize, ok)
+	}
+
+	frame[6] ^= 0xFF
+	if _, ok := parseFlacFrameHeader(frame); ok {
+		t.Error("header with a bad CRC-8 passed")
+	}
+	if _, ok := parseFlacFrameHeader([]byte{0xFF, 0xF8, 0x69}); ok {
+		t.Error("short header passed")
+	}
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	id3v2 "github.com/bogem/id3v2"
+	"github.com/go-flac/flacvorbis"
+	"github.com/go-flac/go-flac"
+)
+
+// Values of the lyrics config setting.
+const (
+	lyricsSidecar  = "sidecar"
+	lyricsEmbedded = "embedded"
+	lyricsBoth     = "both"
+)
+
+func wantLyricsSidecar(config configuration) bool {
+	return config.Lyrics == lyricsSidecar || config.Lyrics == lyricsBoth
+}
+
+func wantLyricsEmbedded(config configuration) bool {
+	return config.Lyrics == lyricsEmbedded || config.Lyrics == lyricsBoth
+}
+
+// syncedLyric is one line of time-synced lyrics.
+type syncedLyric struct {
+	milliseconds int
+	line         string
+}
+
+func getSyncedLyrics(lyrics resLyrics) []syncedLyric {
+	synced := make([]syncedLyric, 0, len(lyrics.LyricsSyncJson))
+	for _, l := range lyrics.LyricsSyncJson {
+		ms, err := strconv.Atoi(l.Milliseconds)
+		if err != nil {
+			continue
+		}
+		synced = append(synced, syncedLyric{ms, l.Line})
+	}
+	return synced
+}
+
+// formatLrc renders synced lyrics in the LRC format.
+func formatLrc(synced []syncedLyric) string {
+	var sb strings.Builder
+	for _, l := range synced {
+		minutes := l.milliseconds / 60000
+		seconds := l.milliseconds % 60000 / 1000
+		hundredths := l.milliseconds % 1000 / 10
+		fmt.Fprintf(&sb, "[%02d:%02d.%02d]%s\n", minutes, seconds, hundredths, l.line)
+	}
+	return sb.String()
+}
+
+// lrcPath is where the sidecar of a song goes: next to it, with the .lrc
+// extension.
+func lrcPath(songPath string) string {
+	return strings.TrimSuffix(songPath, filepath.Ext(songPath)) + ".lrc"
+}
+
+// addLyrics fetches the song's lyrics and, depending on the lyrics config
+// setting, saves the synced ones as an .lrc sidecar and embeds them: plain
+// lyrics as the Vorbis LYRICS field or an ID3 USLT frame, synced lyrics as an
+// ID3 SYLT frame.
+func addLyrics(song resSongInfoData, songPath string, format string, config configuration) error {
+	if !wantLyricsSidecar(config) && !wantLyricsEmbedded(config) {
+		return nil
+	}
+	if song.LyricsId == 0 {
+		return nil
+	}
+	var lyrics resLyrics
+	err := retryOnQuota(func() error {
+		var err error
+		lyrics, err = getLyrics(song.SngId, config)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	synced := getSyncedLyrics(lyrics)
+
+	if wantLyricsSidecar(config) && len(synced) > 0 {
+		err = os.WriteFile(lrcPath(songPath), []byte(formatLrc(synced)), 0644)
+		if err != nil {
+			return err
+		}
+	}
+	if !wantLyricsEmbedded(config) {
+		return nil
+	}
+	if strings.ToUpper(format) == "FLAC" {
+		return embedFlacLyrics(songPath, lyrics.LyricsText)
+	}
+	return embedID3Lyrics(songPath, lyrics.LyricsText, synced)
+}
+
+func embedFlacLyrics(songPath string, text string) error {
+	f, err := flac.ParseFile(songPath)
+	if err != nil {
+		return err
+	}
+	cmts, idx, err := extractFlacComment(f)
+	if err != nil {
+		return err
+	}
+	if cmts == nil {
+		cmts = flacvorbis.New()
+	}
+	setVorbisComment(cmts, "LYRICS", text)
+	cmtsmeta := cmts.Marshal()
+	if idx >= 0 {
+		f.Meta[idx] = &cmtsmeta
+	} else {
+		f.Meta = append(f.Meta, &cmtsmeta)
+	}
+	return f.Save(songPath)
+}
+
+func embedID3Lyrics(songPath string, text string, synced []syncedLyric) error {
+	tag, err := id3v2.Open(songPath, id3v2.Options{Parse: true})
+	if err != nil {
+		return err
+	}
+	defer tag.Close()
+	tag.SetVersion(4)
+
+	tag.DeleteFrames(tag.CommonID("Unsynchronised lyrics/text transcription"))
+	if text != "" {
+		tag.AddUnsynchronisedLyricsFrame(id3v2.UnsynchronisedLyricsFrame{
+			Encoding: id3v2.EncodingUTF8,
+			Language: "XXX",
+			Lyrics:   text,
+		})
+	}
+	tag.DeleteFrames("SYLT")
+	if len(synced) > 0 {
+		tag.AddFrame("SYLT", syltFrame{language: "XXX", lines: synced})
+	}
+	return tag.Save()
+}
+
+// syltFrame is an ID3v2 SYLT (synchronised lyrics) frame, which the id3v2
+// package cannot write itself. Text is UTF-8 and timestamps are in
+// milliseconds.
+type syltFrame struct {
+	language string
+	lines    []syncedLyric
+}
+
+func (f syltFrame) body() []byte {
+	var buf bytes.Buffer
+	buf.WriteByte(id3v2.EncodingUTF8.Key)
+	buf.WriteString(f.language)
+	buf.WriteByte(2) // timestamps in milliseconds
+	buf.WriteByte(1) // content type: lyrics
+	buf.WriteByte(0) // empty content descriptor
+	for _, l := range f.lines {
+		buf.WriteString(l.line)
+		buf.WriteByte(0)
+		binary.Write(&buf, binary.BigEndian, uint32(l.milliseconds))
+	}
+	return buf.Bytes()
+}
+
+func (f syltFrame) Size() int {
+	return len(f.body())
+}
+
+func (f syltFrame) UniqueIdentifier() string {
+	return f.language
+}
+
+func (f syltFrame) WriteTo(w io.Writer) (int64, error) {
+	n, err := w.Write(f.body())
+	return int64(n), err
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"flag"
 	"io"
 	"log"
 	"net/http"
@@ -8,23 +9,22 @@ import (
 	"time"
 )
 
-var lastReqTime int64
+// A failed request is tried again up to maxNetworkRetries times in all,
+// waiting networkBackoff and then twice as long after each failure.
+const maxNetworkRetries = 5
 
-var REQ_MIN_INTERVAL int64 = 500000000
+var networkBackoff = time.Second
 
 func makeReq(method, url string, body io.Reader, config configuration) (*http.Response, error) {
 	var err error
 
-	tDiff := time.Now().UnixNano() - lastReqTime
-	if tDiff < REQ_MIN_INTERVAL {
-		time.Sleep(time.Duration(REQ_MIN_INTERVAL-tDiff) * time.Nanosecond)
-	}
-	lastReqTime = time.Now().UnixNano()
-
 	req, err := http.NewRequest(method, url, body)
 	if err != nil {
 		return nil, err
 	}
+	if limiter := limiterFor(req.URL.Host, config); limiter != nil {
+		limiter.wait(1)
+	}
 	req.Header.Add("Pragma", "no-cache")
 	req.Header.Add("Origin", "https://www.deezer.com")
 	req.Header.Add("Accept-Language", "en-US,en;q=0.9")
@@ -43,10 +43,22 @@ func makeReq(method, url string, body io.Reader, config configuration) (*http.Re
 	req.AddCookie(cookie)
 
 	var res *http.Response
-	res, err = http.DefaultClient.Do(req)
-	for err != nil {
-		log.Print("(network hiccup)")
-		res, err = http.DefaultClient.Do(req)
+	res, err = httpClient.Do(req)
+	for attempt := 1; err != nil && attempt < maxNetworkRetries; attempt++ {
+		// The body was consumed by the failed attempt
+		if req.Body != nil {
+			if req.GetBody == nil {
+				return nil, err
+			}
+			req.Body, err = req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+		}
+		wait := time.Duration(1<<(attempt-1)) * networkBackoff
+		log.Printf("(network hiccup: %s), retrying in %s\n", err, wait)
+		time.Sleep(wait)
+		res, err = httpClient.Do(req)
 	}
 	return res, err
 }
@@ -60,6 +72,24 @@ func printUsage() {
 	log.Println("To download one or more playlists:")
 	log.Println("\tdeezer-music-download playlist <playlist_id> [<playlist_id>...]")
 	log.Println("")
+	log.Println("To download only what changed in one or more playlists since their last sync:")
+	log.Println("\tdeezer-music-download playlist sync [--removed keep|delete|archive] <playlist_id> [<playlist_id>...]")
+	log.Println("")
+	log.Println("To keep downloading what is new in the playlists, artists and favorites listed under [watch]:")
+	log.Println("\tdeezer-music-download watch")
+	log.Println("")
+	log.Println("To check the account behind the configured ARL:")
+	log.Println("\tdeezer-music-download whoami")
+	log.Println("")
+	log.Println("To check the downloaded library, or one folder of it:")
+	log.Println("\tdeezer-music-download verify [--redownload] [<path>]")
+	log.Println("")
+	log.Println("To rewrite the tags and covers of already downloaded songs:")
+	log.Println("\tdeezer-music-download retag [<path>]")
+	log.Println("")
+	log.Println("Options, given before the command:")
+	log.Println("\t--limit-rate <rate>\tcap download speed, e.g. 800k or 2M (overrides max_bandwidth)")
+	log.Println("")
 	log.Println("See README for full details.")
 }
 
@@ -67,13 +97,20 @@ func main() {
 	var err error
 	log.SetFlags(0)
 
-	if len(os.Args) < 3 {
+	flags := flag.NewFlagSet("deezer-music-download", flag.ContinueOnError)
+	flags.Usage = printUsage
+	limitRate := flags.String("limit-rate", "", "")
+	if err = flags.Parse(os.Args[1:]); err != nil {
+		return
+	}
+
+	if flags.NArg() < 1 {
 		printUsage()
 		return
 	}
 
-	command := os.Args[1]
-	args := os.Args[2:]
+	command := flags.Arg(0)
+	args := flags.Args()[1:]
 
 	logFilePath := os.TempDir() + "/deezer-music-download.log"
 	logFile, err := os.Create(logFilePath)
@@ -87,10 +124,46 @@ func main() {
 		log.Fatalf("error reading config file: %s\n", err)
 	}
 
+	httpClient, err = newHttpClient(config.Http)
+	if err != nil {
+		log.Fatalf("error setting up HTTP client: %s\n", err)
+	}
+
+	maxBandwidth := config.MaxBandwidth
+	if *limitRate != "" {
+		maxBandwidth = *limitRate
+	}
+	bandwidth, err := parseBandwidth(maxBandwidth)
+	if err != nil {
+		log.Fatalf("error reading bandwidth limit: %s\n", err)
+	}
+	setBandwidthLimit(bandwidth)
+	defer clearCoverCache()
+
+	switch command {
+	case "album", "playlist":
+		if len(args) == 0 {
+			printUsage()
+			return
+		}
+	}
+
 	switch command {
+	case "whoami", "account":
+		printAccount(config)
+	case "watch":
+		processWatch(config, logFile)
+	case "verify":
+		processVerify(args, config, logFile)
+	case "retag":
+		processRetag(args, config, logFile)
 	case "album":
 		processAlbums(args, config, logFile)
 	case "playlist":
+		if args[0] == "sync" {
+			processPlaylistSync(args[1:], config, logFile)
+			return
+		}
 		processPlaylists(args, config, logFile)
 	default:
 		printUsage()
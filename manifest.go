@@ -0,0 +1,121 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// manifestName is the file, kept in every folder the program downloads to,
+// that records where each song came from and what it looked like when it was
+// written.
+const manifestName = ".deezer-manifest.json"
+
+type manifestEntry struct {
+	TrackId string `json:"track_id"`
+	AlbumId string `json:"album_id"`
+	Format  string `json:"format"`
+	Size    int64  `json:"size"`
+	Sha256  string `json:"sha256"`
+}
+
+// dirManifest maps a song's file name to its entry.
+type dirManifest map[string]manifestEntry
+
+func readManifest(dir string) (dirManifest, error) {
+	manifest := make(dirManifest)
+	data, err := os.ReadFile(filepath.Join(dir, manifestName))
+	if errors.Is(err, os.ErrNotExist) {
+		return manifest, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(data, &manifest)
+	return manifest, err
+}
+
+func writeManifest(dir string, manifest dirManifest) error {
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dir, manifestName), data, 0644)
+}
+
+func fileChecksum(path string) (int64, string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	size, err := io.Copy(h, f)
+	if err != nil {
+		return 0, "", err
+	}
+	return size, hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// recordInManifest stores the song's Deezer IDs, format, size and checksum in
+// the manifest of the folder it was written to.
+func recordInManifest(songPath string, trackId string, albumId string, format string) error {
+	size, sum, err := fileChecksum(songPath)
+	if err != nil {
+		return err
+	}
+	dir := filepath.Dir(songPath)
+	manifest, err := readManifest(dir)
+	if err != nil {
+		return err
+	}
+	manifest[filepath.Base(songPath)] = manifestEntry{
+		TrackId: trackId,
+		AlbumId: albumId,
+		Format:  format,
+		Size:    size,
+		Sha256:  sum,
+	}
+	return writeManifest(dir, manifest)
+}
+
+// forgetInManifest removes the song's entry from its folder's manifest.
+func forgetInManifest(songPath string) error {
+	dir := filepath.Dir(songPath)
+	manifest, err := readManifest(dir)
+	if err != nil {
+		return err
+	}
+	if _, ok := manifest[filepath.Base(songPath)]; !ok {
+		return nil
+	}
+	delete(manifest, filepath.Base(songPath))
+	return writeManifest(dir, manifest)
+}
+
+// moveInManifest carries the song's entry over to the manifest of the folder
+// it was moved to.
+func moveInManifest(oldPath string, newPath string) error {
+	manifest, err := readManifest(filepath.Dir(oldPath))
+	if err != nil {
+		return err
+	}
+	entry, ok := manifest[filepath.Base(oldPath)]
+	if !ok {
+		return nil
+	}
+	err = forgetInManifest(oldPath)
+	if err != nil {
+		return err
+	}
+	newManifest, err := readManifest(filepath.Dir(newPath))
+	if err != nil {
+		return err
+	}
+	newManifest[filepath.Base(newPath)] = entry
+	return writeManifest(filepath.Dir(newPath), newManifest)
+}
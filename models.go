@@ -5,11 +5,53 @@ import "encoding/json"
 // Data models extracted from the original main.go
 
 type configuration struct {
-	Arl          string `toml:"arl"`
-	LicenseToken string `toml:"license_token"`
-	DestDir      string `toml:"dest_dir"`
-	Iv           string `toml:"iv"`
-	PreKey       string `toml:"pre_key"`
+	Arl             string          `toml:"arl"`
+	LicenseToken    string          `toml:"license_token"`
+	DestDir         string          `toml:"dest_dir"`
+	Iv              string          `toml:"iv"`
+	PreKey          string          `toml:"pre_key"`
+	RateLimit       rateLimitConfig `toml:"rate_limit"`
+	Http            httpConfig      `toml:"http"`
+	Watch           watchConfig     `toml:"watch"`
+	MaxBandwidth    string          `toml:"max_bandwidth"`
+	LegacyArtistTag bool            `toml:"legacy_artist_tag"`
+	Lyrics          string          `toml:"lyrics"`
+
+	AlbumPathTemplate       string `toml:"album_path_template"`
+	PlaylistPathTemplate    string `toml:"playlist_path_template"`
+	CompilationsDir         string `toml:"compilations_dir"`
+	CompilationPathTemplate string `toml:"compilation_path_template"`
+	PlaylistMode            string `toml:"playlist_mode"`
+	PlaylistsDir            string `toml:"playlists_dir"`
+	PlaylistFolderTemplate  string `toml:"playlist_folder_template"`
+	SyncRemoved             string `toml:"sync_removed"`
+	ArchiveDir              string `toml:"archive_dir"`
+	MultiDisc               string `toml:"multi_disc"`
+	MaxNameBytes            int    `toml:"max_name_bytes"`
+	AsciiNames              bool   `toml:"ascii_names"`
+}
+
+type watchConfig struct {
+	IntervalMinutes float64  `toml:"interval_minutes"`
+	Playlists       []string `toml:"playlists"`
+	Artists         []string `toml:"artists"`
+	Favorites       bool     `toml:"favorites"`
+	ArtistBackfill  bool     `toml:"artist_backfill"`
+}
+
+type httpConfig struct {
+	Proxy              string  `toml:"proxy"`
+	TimeoutSeconds     float64 `toml:"timeout_seconds"`
+	IdleTimeoutSeconds float64 `toml:"idle_timeout_seconds"`
+	MaxConnsPerHost    int     `toml:"max_conns_per_host"`
+	CaBundle           string  `toml:"ca_bundle"`
+}
+
+type rateLimitConfig struct {
+	Requests         int     `toml:"requests"`
+	WindowSeconds    float64 `toml:"window_seconds"`
+	CdnRequests      int     `toml:"cdn_requests"`
+	CdnWindowSeconds float64 `toml:"cdn_window_seconds"`
 }
 
 type resTrackAlbum struct {
@@ -57,6 +99,7 @@ type resTrack struct {
 type resTracks struct {
 	Data  []resTrack `json:"data"`
 	Total int        `json:"total"`
+	Next  string     `json:"next"`
 }
 
 type resSongInfoArtist struct {
@@ -107,6 +150,28 @@ type resSongInfoContributors struct {
 	Featuring      []string `json:"featuring"`
 	Narrator       []string `json:"narrator"`
 	MusicPublisher []string `json:"music_publisher"`
+	// Roles holds every role Deezer lists, including the ones above
+	Roles map[string][]string `json:"-"`
+}
+
+func (c *resSongInfoContributors) UnmarshalJSON(data []byte) error {
+	type plain resSongInfoContributors
+	if err := json.Unmarshal(data, (*plain)(c)); err != nil {
+		return err
+	}
+
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	c.Roles = make(map[string][]string, len(raw))
+	for role, value := range raw {
+		var names []string
+		if json.Unmarshal(value, &names) == nil && len(names) > 0 {
+			c.Roles[role] = names
+		}
+	}
+	return nil
 }
 
 type resSongInfoExplicitTrackContent struct {
@@ -242,13 +307,15 @@ type resSongUrl struct {
 	} `json:"data"`
 }
 
+type resAlbumSongs struct {
+	Data          []resSongInfoData `json:"data"`
+	Count         int               `json:"count"`
+	Total         int               `json:"total"`
+	FilteredCount int               `json:"filtered_count"`
+}
+
 type resAlbumInfo struct {
-	Songs struct {
-		Data          []resSongInfoData `json:"data"`
-		Count         int               `json:"count"`
-		Total         int               `json:"total"`
-		FilteredCount int               `json:"filtered_count"`
-	} `json:"SONGS"`
+	Songs resAlbumSongs `json:"SONGS"`
 }
 
 type resAlbumGenres struct {
@@ -355,6 +422,20 @@ type resAlbum struct {
 	Artist                resAlbumArtist        `json:"artist"`
 	Type                  string                `json:"type"`
 	Tracks                resAlbumTracks        `json:"tracks"`
+	// ReplayGain is the album gain computed from its songs' Deezer gain,
+	// when all of them are known; it is not part of the API response.
+	ReplayGain string `json:"-"`
+}
+
+type resArtistAlbums struct {
+	Data []struct {
+		ID          int    `json:"id"`
+		Title       string `json:"title"`
+		RecordType  string `json:"record_type"`
+		ReleaseDate string `json:"release_date"`
+	} `json:"data"`
+	Total int    `json:"total"`
+	Next  string `json:"next"`
 }
 
 type resPlaylist struct {
@@ -362,6 +443,7 @@ type resPlaylist struct {
 	Title     string    `json:"title"`
 	Picture   string    `json:"picture"`
 	PictureXl string    `json:"picture_xl"`
+	NbTracks  int       `json:"nb_tracks"`
 	Tracks    resTracks `json:"tracks"`
 }
 
@@ -374,3 +456,40 @@ type resPing struct {
 		ServerTimestamp int    `json:"SERVER_TIMESTAMP"`
 	} `json:"results"`
 }
+
+type resUserData struct {
+	Error   interface{} `json:"error"`
+	Results struct {
+		User struct {
+			UserId   int    `json:"USER_ID"`
+			BlogName string `json:"BLOG_NAME"`
+			Email    string `json:"EMAIL"`
+			Options  struct {
+				WebHq               bool   `json:"web_hq"`
+				WebLossless         bool   `json:"web_lossless"`
+				MobileHq            bool   `json:"mobile_hq"`
+				MobileLossless      bool   `json:"mobile_lossless"`
+				LicenseToken        string `json:"license_token"`
+				LicenseCountry      string `json:"license_country"`
+				ExpirationTimestamp int64  `json:"expiration_timestamp"`
+			} `json:"OPTIONS"`
+		} `json:"USER"`
+		Country   string `json:"COUNTRY"`
+		OfferName string `json:"OFFER_NAME"`
+		CheckForm string `json:"checkForm"`
+	} `json:"results"`
+}
+
+type resLyricsSyncLine struct {
+	LrcTimestamp string `json:"lrc_timestamp"`
+	Milliseconds string `json:"milliseconds"`
+	Duration     string `json:"duration"`
+	Line         string `json:"line"`
+}
+
+type resLyrics struct {
+	LyricsText       string              `json:"LYRICS_TEXT"`
+	LyricsSyncJson   []resLyricsSyncLine `json:"LYRICS_SYNC_JSON"`
+	LyricsCopyrights string              `json:"LYRICS_COPYRIGHTS"`
+	LyricsWriters    string              `json:"LYRICS_WRITERS"`
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"log"
 	"os"
@@ -9,187 +10,419 @@ import (
 	"strings"
 )
 
-func processAlbums(args []string, config configuration, logFile *os.File) {
-album_loop:
-	for idx, albumId := range args {
-		log.Printf("[%03d/%03d] Downloading album %s\n", idx+1, len(args), albumId)
-		albumInfo, err := getAlbumSongs(albumId, config)
+var errNoFormats = errors.New("no available formats")
+
+// maxIntegrityAttempts is how many times a song is downloaded before a file
+// that fails verifyDownload is treated as an error.
+const maxIntegrityAttempts = 3
+
+// downloadTrack fetches song in the best format the account can stream, then
+// tags it, embeds its cover and returns the path it was saved to. It returns
+// errNoFormats when no format is available. dest says where the song is
+// saved and position is its 1-based place in batch.
+func downloadTrack(song resSongInfoData, album resAlbum, config configuration, dest songDestination, batch *batchProgress, position int) (string, error) {
+	var err error
+
+	formats := []string{"FLAC", "MP3_320", "MP3_256", "MP3_128"}
+	var selectedFormat string
+	var songUrl string
+	for _, f := range formats {
+		songUrlDataTry, errTry := getSongUrlData(song.TrackToken, f, config)
+		if errTry != nil {
+			continue
+		}
+		songUrlTry, errTry2 := getSongUrl(songUrlDataTry)
+		if errTry2 != nil {
+			continue
+		}
+		selectedFormat = f
+		songUrl = songUrlTry
+		break
+	}
+	if selectedFormat == "" {
+		return "", errNoFormats
+	}
+
+	songPath := claimPath(getSongPath(song, album, config, dest, selectedFormat), song.SngId)
+	songDir := path.Dir(songPath)
+	coverFilePath := songDir + "/cover.jpg"
+
+	if dest.mixedAlbums {
+		err = os.MkdirAll(songDir, os.ModePerm)
+		if err == nil {
+			coverFilePath, err = albumCoverCache(album)
+		}
+	} else {
+		err = ensureSongDirectoryExists(songPath, album.CoverXl)
+	}
+	if err != nil {
+		return "", fmt.Errorf("error preparing directory for song: %w", err)
+	}
+	expected := expectedSize(song, selectedFormat)
+	progress := batch.track(position, getTitle(song), expected)
+	for attempt := 1; ; attempt++ {
+		err = downloadSong(songUrl, songPath, song.SngId, 0, config, progress)
 		if err != nil {
-			log.Fatalf("error getting album songs: %s\n", err)
+			return "", fmt.Errorf("error downloading song: %w", err)
+		}
+		err = verifyDownload(songPath, selectedFormat, expected)
+		if err == nil {
+			progress.done()
+			break
 		}
+		if attempt >= maxIntegrityAttempts {
+			return "", fmt.Errorf("downloaded song %s is incomplete after %d attempts: %w", songPath, attempt, err)
+		}
+		log.Printf("Integrity check failed for %s (%s), retrying\n", songPath, err)
+	}
+
+	err = tagSong(song, album, songPath, selectedFormat, coverFilePath, config)
+	if err != nil {
+		return "", err
+	}
+	if strings.ToUpper(selectedFormat) != "FLAC" {
+		log.Printf("Downloaded %s as %s and added ID3 tags", song.SngTitle, selectedFormat)
+	}
+
+	err = recordInManifest(songPath, song.SngId, song.AlbId, selectedFormat)
+	if err != nil {
+		return "", fmt.Errorf("error recording song in manifest: %w", err)
+	}
+	return songPath, nil
+}
 
-		album, err := getAlbum(albumId, config)
+// tagSong writes the song's metadata, cover and lyrics into the file at
+// songPath: Vorbis comments and a PICTURE block for FLACs, ID3v2 frames
+// otherwise.
+func tagSong(song resSongInfoData, album resAlbum, songPath string, format string, coverFilePath string, config configuration) error {
+	var err error
+	if strings.ToUpper(format) == "FLAC" {
+		err = addTags(song, songPath, album, format, config)
 		if err != nil {
-			log.Fatalf("error getting album: %s\n", err)
-		}
-
-		// Ensure album.NbDiscs is set: compute from albumInfo if API didn't provide it
-		if album.NbDiscs == 0 {
-			maxDisc := 0
-			for _, s := range albumInfo.Songs.Data {
-				if s.DiskNumber != "" {
-					if d, err := strconv.Atoi(s.DiskNumber); err == nil {
-						if d > maxDisc {
-							maxDisc = d
-						}
-					}
-				}
-			}
-			if maxDisc > 0 {
-				album.NbDiscs = maxDisc
-			}
+			return fmt.Errorf("error adding tags to song: %w", err)
+		}
+		err = addCover(songPath, coverFilePath)
+		if err != nil {
+			return fmt.Errorf("error adding cover image to song: %w", err)
 		}
+	} else {
+		err = addID3Tags(song, songPath, coverFilePath, album, format, config)
+		if err != nil {
+			return fmt.Errorf("error adding ID3 tags to MP3: %w", err)
+		}
+	}
 
-		for _, song := range albumInfo.Songs.Data {
-			formats := []string{"FLAC", "MP3_320", "MP3_256", "MP3_128"}
-			var selectedFormat string
-			var songUrl string
-			for _, f := range formats {
-				songUrlDataTry, errTry := getSongUrlData(song.TrackToken, f, config)
-				if errTry != nil {
-					continue
-				}
-				songUrlTry, errTry2 := getSongUrl(songUrlDataTry)
-				if errTry2 != nil {
-					continue
-				}
-				selectedFormat = f
-				songUrl = songUrlTry
-				break
-			}
+	// Songs without lyrics are common, so a failed lookup is not fatal
+	err = addLyrics(song, songPath, format, config)
+	if err != nil {
+		log.Printf("could not add lyrics to %s: %s\n", songPath, err)
+	}
+	return nil
+}
 
-			if selectedFormat == "" {
-				msg := fmt.Sprintf("error getting URL for song \"%s\" by %s from \"%s\": no available formats\n",
-					song.SngTitle, song.ArtName, song.AlbTitle)
-				log.Print(msg)
-				logFile.Write([]byte(msg))
-				log.Print("Album download failed: " + albumId + "\n\n")
-				logFile.Write([]byte("Album download failed: " + albumId + "\n"))
-				continue album_loop
-			}
+// checkAlbumCompleteness compares the songs that could be listed against the
+// album's declared track count and looks for gaps in each disc's numbering,
+// so region-locked or missing tracks are reported instead of leaving a
+// silently incomplete album.
+func checkAlbumCompleteness(album resAlbum, songs resAlbumSongs) []string {
+	var problems []string
+	if album.NbTracks > 0 && len(songs.Data) < album.NbTracks {
+		problems = append(problems, fmt.Sprintf("only %d of %d tracks are available", len(songs.Data), album.NbTracks))
+	}
+	if songs.FilteredCount > 0 {
+		problems = append(problems, fmt.Sprintf("%d tracks were filtered out (region-locked or unavailable)", songs.FilteredCount))
+	}
 
-			songPath := getSongPath(song, album, config, selectedFormat)
-			songDir := path.Dir(songPath)
-			coverFilePath := songDir + "/cover.jpg"
+	listed := make(map[string]bool)
+	for _, song := range songs.Data {
+		listed[song.SngId] = true
+	}
+	for _, track := range album.Tracks.Data {
+		if !track.Readable || !listed[strconv.Itoa(track.ID)] {
+			problems = append(problems, fmt.Sprintf("track \"%s\" is unavailable", track.Title))
+		}
+	}
 
-			err = ensureSongDirectoryExists(songPath, album.CoverXl)
-			if err != nil {
-				log.Fatalf("error preparing directory for song: %s\n", err)
+	discTracks := make(map[int]map[int]bool)
+	maxDisc := album.NbDiscs
+	for _, song := range songs.Data {
+		disc, err := strconv.Atoi(song.DiskNumber)
+		if err != nil || disc < 1 {
+			disc = 1
+		}
+		trackNum, err := strconv.Atoi(song.TrackNumber)
+		if err != nil {
+			continue
+		}
+		if discTracks[disc] == nil {
+			discTracks[disc] = make(map[int]bool)
+		}
+		discTracks[disc][trackNum] = true
+		if disc > maxDisc {
+			maxDisc = disc
+		}
+	}
+	for disc := 1; disc <= maxDisc; disc++ {
+		tracks := discTracks[disc]
+		if len(tracks) == 0 {
+			problems = append(problems, fmt.Sprintf("disc %d has no available tracks", disc))
+			continue
+		}
+		lastTrack := 0
+		for trackNum := range tracks {
+			if trackNum > lastTrack {
+				lastTrack = trackNum
 			}
-			err = downloadSong(songUrl, songPath, song.SngId, 0, config)
-			if err != nil {
-				log.Fatalf("error downloading song: %s\n", err)
+		}
+		var missing []string
+		for trackNum := 1; trackNum <= lastTrack; trackNum++ {
+			if !tracks[trackNum] {
+				missing = append(missing, strconv.Itoa(trackNum))
 			}
+		}
+		if len(missing) > 0 {
+			problems = append(problems, fmt.Sprintf("disc %d is missing track(s) %s", disc, strings.Join(missing, ", ")))
+		}
+	}
+	return problems
+}
 
-			if strings.ToUpper(selectedFormat) == "FLAC" {
-				err = addTags(song, songPath, album)
-				if err != nil {
-					log.Fatalf("error adding tags to song: %s\n", err)
-				}
-				err = addCover(songPath, coverFilePath)
-				if err != nil {
-					log.Fatalf("error adding cover image to song: %s\n", err)
-				}
-			} else {
-				err = addID3Tags(song, songPath, coverFilePath, album)
-				if err != nil {
-					log.Fatalf("error adding ID3 tags to MP3: %s\n", err)
-				}
-				log.Printf("Downloaded %s as %s and added ID3 tags", song.SngTitle, selectedFormat)
+// albumDetailsCache holds, by album ID, what completeAlbum worked out from the
+// songs of albums fetched during this run.
+var albumDetailsCache = make(map[string]resAlbum)
+
+// completeAlbum fills in what the public album API leaves out from songs, the
+// album's song list: the number of discs and, when every song is listed, the
+// album gain.
+func completeAlbum(album *resAlbum, songs []resSongInfoData) {
+	if album.NbDiscs == 0 {
+		for _, song := range songs {
+			if disc, err := strconv.Atoi(song.DiskNumber); err == nil && disc > album.NbDiscs {
+				album.NbDiscs = disc
 			}
 		}
-		log.Print("Album download succeeded: " + albumId + "\n\n")
-		logFile.Write([]byte("Album download succeeded: " + albumId + "\n"))
 	}
+	// Album gain is only right when it covers the whole album
+	if len(songs) >= album.NbTracks {
+		album.ReplayGain = getAlbumGain(songs)
+	}
+	albumDetailsCache[strconv.Itoa(album.ID)] = resAlbum{NbDiscs: album.NbDiscs, ReplayGain: album.ReplayGain}
 }
 
-func processPlaylists(args []string, config configuration, logFile *os.File) {
-playlist_loop:
-	for idx, playlistId := range args {
-		log.Printf("[%03d/%03d] Downloading playlist %s\n", idx+1, len(args), playlistId)
-		playlist, err := getPlaylist(playlistId, config)
+// loadAlbumDetails completes album, fetching its song list once per run, for
+// songs downloaded or tagged outside an album download.
+func loadAlbumDetails(album *resAlbum, config configuration) error {
+	if cached, ok := albumDetailsCache[strconv.Itoa(album.ID)]; ok {
+		album.NbDiscs = cached.NbDiscs
+		album.ReplayGain = cached.ReplayGain
+		return nil
+	}
+	albumInfo, err := getAlbumSongs(strconv.Itoa(album.ID), config)
+	if err != nil {
+		return err
+	}
+	completeAlbum(album, albumInfo.Songs.Data)
+	return nil
+}
+
+func processAlbums(args []string, config configuration, logFile *os.File) {
+	for idx, albumId := range args {
+		log.Printf("[%03d/%03d] Downloading album %s\n", idx+1, len(args), albumId)
+		_, err := downloadAlbum(albumId, config, logFile)
 		if err != nil {
-			log.Fatalf("error getting playlist: %s\n", err)
+			log.Fatalf("%s%s\n", err, errorHint(err))
 		}
+	}
+}
 
-		tracks := playlist.Tracks
-		if tracks.Total == 0 || len(tracks.Data) == 0 {
-			tracksParsed, err2 := getPlaylistSongs(playlistId, config)
-			if err2 == nil {
-				tracks = tracksParsed
-			} else {
-				log.Printf("could not extract playlist tracks from page: %v\n", err2)
-			}
+// downloadAlbum downloads every song of an album. It reports false, after
+// logging why, when the album is unavailable or one of its songs has no
+// available format; an album that is incomplete on Deezer still counts as
+// downloaded. Other failures are returned.
+func downloadAlbum(albumId string, config configuration, logFile *os.File) (bool, error) {
+	albumInfo, err := getAlbumSongs(albumId, config)
+	if err != nil {
+		return false, fmt.Errorf("error getting album songs: %w", err)
+	}
+
+	var album resAlbum
+	err = retryOnQuota(func() error {
+		var err error
+		album, err = getAlbum(albumId, config)
+		return err
+	})
+	if isUnavailable(err) {
+		msg := fmt.Sprintf("error getting album %s: %s\n", albumId, err)
+		log.Print(msg)
+		logFile.Write([]byte(msg))
+		log.Print("Album download failed: " + albumId + "\n\n")
+		logFile.Write([]byte("Album download failed: " + albumId + "\n"))
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("error getting album: %w", err)
+	}
+
+	completeAlbum(&album, albumInfo.Songs.Data)
+
+	problems := checkAlbumCompleteness(album, albumInfo.Songs)
+	for _, problem := range problems {
+		msg := fmt.Sprintf("album %s: %s\n", albumId, problem)
+		log.Print(msg)
+		logFile.Write([]byte(msg))
+	}
+
+	batch := newBatchProgress(len(albumInfo.Songs.Data))
+	for i, song := range albumInfo.Songs.Data {
+		dest := songDestination{template: songTemplate(album, config, config.AlbumPathTemplate)}
+		_, err = downloadTrack(song, album, config, dest, batch, i+1)
+		if errors.Is(err, errNoFormats) {
+			msg := fmt.Sprintf("error getting URL for song \"%s\" by %s from \"%s\": no available formats\n",
+				song.SngTitle, song.ArtName, song.AlbTitle)
+			log.Print(msg)
+			logFile.Write([]byte(msg))
+			log.Print("Album download failed: " + albumId + "\n\n")
+			logFile.Write([]byte("Album download failed: " + albumId + "\n"))
+			return false, nil
+		}
+		if err != nil {
+			return false, err
 		}
+	}
+	if len(problems) > 0 {
+		log.Print("Album download incomplete: " + albumId + "\n\n")
+		logFile.Write([]byte("Album download incomplete: " + albumId + "\n"))
+		return true, nil
+	}
+	log.Print("Album download succeeded: " + albumId + "\n\n")
+	logFile.Write([]byte("Album download succeeded: " + albumId + "\n"))
+	return true, nil
+}
 
-		for _, track := range tracks.Data {
-			songInfo, err := getSongInfo(track.Id, config)
-			if err != nil {
-				log.Fatalf("error getting song info: %s\n", err)
-			}
-			song := songInfo.Data
+// listPlaylist fetches a playlist and its tracks, falling back to the
+// playlist page when the API lists none, and warns when fewer tracks could be
+// listed than the playlist declares.
+func listPlaylist(playlistId string, config configuration, logFile *os.File) (resPlaylist, resTracks, error) {
+	var playlist resPlaylist
+	err := retryOnQuota(func() error {
+		var err error
+		playlist, err = getPlaylist(playlistId, config)
+		return err
+	})
+	if err != nil {
+		return playlist, resTracks{}, fmt.Errorf("error getting playlist: %w", err)
+	}
 
-			album, err := getAlbum(song.AlbId, config)
-			if err != nil {
-				log.Fatalf("error getting album: %s\n", err)
-			}
+	tracks := playlist.Tracks
+	if tracks.Total == 0 || len(tracks.Data) == 0 {
+		tracksParsed, err2 := getPlaylistSongs(playlistId, config)
+		if err2 == nil {
+			tracks = tracksParsed
+		} else {
+			log.Printf("could not extract playlist tracks from page: %v\n", err2)
+		}
+	}
 
-			formats := []string{"FLAC", "MP3_320", "MP3_256", "MP3_128"}
-			var selectedFormat string
-			var songUrl string
-			for _, f := range formats {
-				songUrlDataTry, errTry := getSongUrlData(song.TrackToken, f, config)
-				if errTry != nil {
-					continue
-				}
-				songUrlTry, errTry2 := getSongUrl(songUrlDataTry)
-				if errTry2 != nil {
-					continue
-				}
-				selectedFormat = f
-				songUrl = songUrlTry
-				break
-			}
+	declaredTotal := declaredTrackCount(playlist, tracks)
+	if declaredTotal > 0 && len(tracks.Data) != declaredTotal {
+		msg := fmt.Sprintf("warning: playlist %s declares %d tracks but only %d could be listed\n",
+			playlistId, declaredTotal, len(tracks.Data))
+		log.Print(msg)
+		logFile.Write([]byte(msg))
+	}
+	return playlist, tracks, nil
+}
+
+// declaredTrackCount returns how many tracks the playlist says it has, or 0
+// when it does not say.
+func declaredTrackCount(playlist resPlaylist, tracks resTracks) int {
+	if playlist.NbTracks > 0 {
+		return playlist.NbTracks
+	}
+	return tracks.Total
+}
+
+// fetchPlaylistSong gets the song info and album, with its details, of a
+// playlist track. Check the error with isUnavailable to skip songs that
+// cannot be had.
+func fetchPlaylistSong(track resTrack, config configuration) (resSongInfoData, resAlbum, error) {
+	var album resAlbum
+	songInfo, err := getSongInfo(track.Id, config)
+	if err != nil {
+		return resSongInfoData{}, album, fmt.Errorf("error getting song info: %w", err)
+	}
+	song := songInfo.Data
+
+	err = retryOnQuota(func() error {
+		var err error
+		album, err = getAlbum(song.AlbId, config)
+		return err
+	})
+	if err != nil {
+		return song, album, fmt.Errorf("error getting album %s: %w", song.AlbId, err)
+	}
+	err = loadAlbumDetails(&album, config)
+	if err != nil {
+		return song, album, fmt.Errorf("error getting songs of album %s: %w", song.AlbId, err)
+	}
+	return song, album, nil
+}
+
+func processPlaylists(args []string, config configuration, logFile *os.File) {
+	for idx, playlistId := range args {
+		log.Printf("[%03d/%03d] Downloading playlist %s\n", idx+1, len(args), playlistId)
+		playlist, tracks, err := listPlaylist(playlistId, config, logFile)
+		if isUnavailable(err) {
+			msg := fmt.Sprintf("%s\n", err)
+			log.Print(msg)
+			logFile.Write([]byte(msg))
+			log.Print("Playlist download failed: " + playlistId + "\n\n")
+			logFile.Write([]byte("Playlist download failed: " + playlistId + "\n"))
+			continue
+		}
+		if err != nil {
+			log.Fatalf("%s%s\n", err, errorHint(err))
+		}
 
-			if selectedFormat == "" {
-				msg := fmt.Sprintf("error getting URL for song \"%s\" by %s from \"%s\": no available formats\n",
-					song.SngTitle, song.ArtName, song.AlbTitle)
+		var entries []playlistEntry
+		batch := newBatchProgress(len(tracks.Data))
+		for i, track := range tracks.Data {
+			song, album, err := fetchPlaylistSong(track, config)
+			if isUnavailable(err) {
+				msg := fmt.Sprintf("skipping \"%s\" by %s: %s\n", track.Title, track.Artist.Name, err)
 				log.Print(msg)
 				logFile.Write([]byte(msg))
-				log.Print("Playlist download failed: " + playlistId + "\n\n")
-				logFile.Write([]byte("Playlist download failed: " + playlistId + "\n"))
-				continue playlist_loop
+				continue
 			}
-
-			songPath := getSongPath(song, album, config, selectedFormat)
-			songDir := path.Dir(songPath)
-			coverFilePath := songDir + "/cover.jpg"
-
-			err = ensureSongDirectoryExists(songPath, album.CoverXl)
 			if err != nil {
-				log.Fatalf("error preparing directory for song: %s\n", err)
+				log.Fatalf("%s%s\n", err, errorHint(err))
+			}
+
+			dest := playlistDestination(playlist, album, config, i+1)
+			songPath, err := downloadTrack(song, album, config, dest, batch, i+1)
+			if errors.Is(err, errNoFormats) {
+				msg := fmt.Sprintf("skipping \"%s\" by %s: no available formats\n", song.SngTitle, song.ArtName)
+				log.Print(msg)
+				logFile.Write([]byte(msg))
+				continue
 			}
-			err = downloadSong(songUrl, songPath, song.SngId, 0, config)
 			if err != nil {
-				log.Fatalf("error downloading song: %s\n", err)
+				log.Fatalln(err)
 			}
+			entries = append(entries, newPlaylistEntry(song, songPath))
+		}
 
-			if strings.ToUpper(selectedFormat) == "FLAC" {
-				err = addTags(song, songPath, album)
-				if err != nil {
-					log.Fatalf("error adding tags to song: %s\n", err)
-				}
-				err = addCover(songPath, coverFilePath)
-				if err != nil {
-					log.Fatalf("error adding cover image to song: %s\n", err)
-				}
-			} else {
-				err = addID3Tags(song, songPath, coverFilePath, album)
-				if err != nil {
-					log.Fatalf("error adding ID3 tags to MP3: %s\n", err)
-				}
-				log.Printf("Downloaded %s as %s and added ID3 tags", song.SngTitle, selectedFormat)
-			}
+		if declaredTotal := declaredTrackCount(playlist, tracks); declaredTotal > 0 && len(entries) != declaredTotal {
+			msg := fmt.Sprintf("warning: playlist %s declares %d tracks but %d were downloaded\n",
+				playlistId, declaredTotal, len(entries))
+			log.Print(msg)
+			logFile.Write([]byte(msg))
+		}
+
+		m3uPath := playlistFilePath(playlistId, playlist, config)
+		err = writePlaylistFile(m3uPath, playlistId, entries)
+		if err != nil {
+			log.Fatalf("error writing playlist file %s: %s\n", m3uPath, err)
 		}
 		log.Print("Playlist download succeeded: " + playlistId + "\n\n")
 		logFile.Write([]byte("Playlist download succeeded: " + playlistId + "\n"))
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// defaultPathTemplate reproduces the original artist / artist - album /
+// NN - title layout.
+const defaultPathTemplate = "{albumartist}/{albumartist} - {album}/{track:02} - {title}"
+
+// Layouts for the discs of a multi-disc album, when the path template does
+// not place {disc} itself.
+const (
+	multiDiscFolder = "folder"
+	multiDiscPrefix = "prefix"
+)
+
+// templateField matches a {name} or {name:02} placeholder in a path template.
+var templateField = regexp.MustCompile(`\{([a-z_]+)(?::([0-9]+))?\}`)
+
+// emptyBrackets matches the brackets left around a field that expanded to
+// nothing, e.g. "Title ()" when a song has no version.
+var emptyBrackets = regexp.MustCompile(`\(\s*\)|\[\s*\]`)
+
+// pathTemplateFields are the placeholders a path template may use.
+var pathTemplateFields = []string{
+	"albumartist", "artist", "album", "title", "track", "disc", "year",
+	"isrc", "explicit", "record_type", "version", "format", "playlist",
+	"position",
+}
+
+// Where compilations are saved by default: in their own folder under
+// dest_dir, one folder per album.
+const (
+	defaultCompilationsDir         = "Compilations"
+	defaultCompilationPathTemplate = "{album}/{track:02} - {artist} - {title}"
+)
+
+// songDestination says where downloadTrack saves a song: a path template and
+// the values of the fields it uses that do not come from the song itself,
+// such as its playlist. mixedAlbums is set when songs of many albums share a
+// folder, which then gets no cover.jpg of its own. When path is set, the song
+// is saved there instead, with the extension of the format it comes in.
+type songDestination struct {
+	template    string
+	fields      map[string]string
+	mixedAlbums bool
+	path        string
+}
+
+// songTemplate returns the path template for a song of album: template, the
+// album or playlist one, or the compilation template under compilations_dir
+// when album is a compilation.
+func songTemplate(album resAlbum, config configuration, template string) string {
+	if !isCompilation(album) {
+		return template
+	}
+	if config.CompilationsDir == "" {
+		return config.CompilationPathTemplate
+	}
+	return strings.TrimSuffix(config.CompilationsDir, "/") + "/" + config.CompilationPathTemplate
+}
+
+// checkPathTemplate reports placeholders that getSongPath cannot fill.
+func checkPathTemplate(template string) error {
+	if strings.TrimSpace(template) == "" {
+		return fmt.Errorf("template is empty")
+	}
+	known := make(map[string]bool)
+	for _, field := range pathTemplateFields {
+		known[field] = true
+	}
+	for _, match := range templateField.FindAllStringSubmatch(template, -1) {
+		if !known[match[1]] {
+			return fmt.Errorf("unknown field {%s}", match[1])
+		}
+	}
+	return nil
+}
+
+// songPathFields returns the value of every path template field for song.
+// {title} includes the song's version, such as "(Live)", so that versions of
+// one song do not collide; getSongPath drops it when the template places
+// {version} itself.
+func songPathFields(song resSongInfoData, album resAlbum, format string) map[string]string {
+	albumTitle := song.AlbTitle
+	if albumTitle == "" {
+		albumTitle = album.Title
+	}
+	albumArtist := getAlbumArtist(album)
+	if albumArtist == "" {
+		albumArtist = song.ArtName
+	}
+	year := extractYear(album.ReleaseDate)
+	if year == "" {
+		year = extractYear(song.PhysicalReleaseDate)
+	}
+	disc := song.DiskNumber
+	if disc == "" {
+		disc = "1"
+	}
+	explicit := ""
+	if song.ExplicitLyrics == "1" || song.ExplicitTrackContent.ExplicitLyricsStatus == 1 {
+		explicit = "Explicit"
+	}
+	return map[string]string{
+		"albumartist": albumArtist,
+		"artist":      song.ArtName,
+		"album":       albumTitle,
+		"title":       getTitle(song),
+		"track":       song.TrackNumber,
+		"disc":        disc,
+		"year":        year,
+		"isrc":        song.Isrc,
+		"explicit":    explicit,
+		"record_type": album.RecordType,
+		"version":     song.Version,
+		"format":      format,
+	}
+}
+
+// fileNameReserve is the room kept at the end of a file name for its
+// extension, a multi-disc prefix and a collision suffix.
+const fileNameReserve = 16
+
+// expandPathTemplate fills template's placeholders from fields. Each value is
+// sanitized on its own, so only the template's own slashes separate
+// directories; segments that end up empty are dropped, and the others are
+// fitted to the configured name rules.
+func expandPathTemplate(template string, fields map[string]string, config configuration) string {
+	var segments []string
+	parts := strings.Split(template, "/")
+	for i, segment := range parts {
+		expanded := templateField.ReplaceAllStringFunc(segment, func(placeholder string) string {
+			match := templateField.FindStringSubmatch(placeholder)
+			value := fields[match[1]]
+			if value == "" {
+				return ""
+			}
+			if match[2] != "" {
+				width, _ := strconv.Atoi(match[2])
+				if n, err := strconv.Atoi(value); err == nil {
+					value = fmt.Sprintf("%0*d", width, n)
+				}
+			}
+			return SanitizePath(value)
+		})
+		expanded = emptyBrackets.ReplaceAllString(expanded, "")
+		expanded = strings.Join(strings.Fields(expanded), " ")
+		if expanded == "" {
+			continue
+		}
+		maxBytes := config.MaxNameBytes
+		if i == len(parts)-1 {
+			maxBytes -= fileNameReserve
+		}
+		segments = append(segments, fitPathSegment(expanded, maxBytes, config.AsciiNames))
+	}
+	return strings.Join(segments, "/")
+}
+
+// applyDiscLayout separates the discs of a multi-disc album in relPath, the
+// expanded template: each disc gets a CD<n> folder, or the file name gets a
+// "<n>-" prefix so that 01 from disc 2 becomes 2-01.
+func applyDiscLayout(relPath string, layout string, disc string) string {
+	dir, file := path.Split(relPath)
+	if layout == multiDiscPrefix {
+		return dir + disc + "-" + file
+	}
+	return dir + "CD" + disc + "/" + file
+}
+
+// claimedPaths maps every path handed out by claimPath during this run to the
+// Deezer track ID saved there.
+var claimedPaths = make(map[string]string)
+
+// claimPath reserves songPath for trackId. When the path was already claimed
+// in this run, or the folder's manifest records another track under it, a
+// " (2)", " (3)"… suffix is added before the extension until it is free.
+func claimPath(songPath string, trackId string) string {
+	ext := path.Ext(songPath)
+	stem := strings.TrimSuffix(songPath, ext)
+	manifest, err := readManifest(path.Dir(songPath))
+	if err != nil {
+		manifest = make(dirManifest)
+	}
+	candidate := songPath
+	for n := 2; ; n++ {
+		owner, claimed := claimedPaths[candidate]
+		if !claimed {
+			owner = manifest[path.Base(candidate)].TrackId
+		}
+		if owner == "" || owner == trackId {
+			claimedPaths[candidate] = trackId
+			return candidate
+		}
+		candidate = fmt.Sprintf("%s (%d)%s", stem, n, ext)
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestExpandPathTemplate(t *testing.T) {
+	config := configuration{MaxNameBytes: defaultMaxNameBytes}
+	fields := map[string]string{
+		"albumartist": "AC/DC",
+		"album":       "Back in Black",
+		"title":       "Hells Bells",
+		"track":       "1",
+		"disc":        "1",
+		"version":     "",
+		"explicit":    "",
+	}
+	tests := []struct {
+		template string
+		want     string
+	}{
+		{defaultPathTemplate, "AC-DC/AC-DC - Back in Black/01 - Hells Bells"},
+		{"{album}/{disc}-{track:03} {title}", "Back in Black/1-001 Hells Bells"},
+		{"{albumartist}/{title} ({version}) [{explicit}]", "AC-DC/Hells Bells"},
+		{"{year}/{album}/{title}", "Back in Black/Hells Bells"},
+		{"{album}/{track:02}", "Back in Black/01"},
+		{"{albumartist}/../{title}", "AC-DC/_/Hells Bells"},
+	}
+	for _, test := range tests {
+		got := expandPathTemplate(test.template, fields, config)
+		if got != test.want {
+			t.Errorf("expandPathTemplate(%q) = %q, want %q", test.template, got, test.want)
+		}
+	}
+}
+
+func TestExpandPathTemplateFitsNames(t *testing.T) {
+	config := configuration{MaxNameBytes: 40}
+	long := strings.Repeat("é", 30)
+	fields := map[string]string{"album": long, "title": long}
+	got := expandPathTemplate("{album}/{title}", fields, config)
+	parts := strings.Split(got, "/")
+	if len(parts) != 2 {
+		t.Fatalf("got %q, want two segments", got)
+	}
+	if len(parts[0]) != 40 {
+		t.Errorf("folder name is %d bytes, want 40", len(parts[0]))
+	}
+	if len(parts[1]) != 40-fileNameReserve {
+		t.Errorf("file name is %d bytes, want %d", len(parts[1]), 40-fileNameReserve)
+	}
+
+	config.AsciiNames = true
+	fields = map[string]string{"albumartist": "Sigur Rós", "title": "Hoppípolla"}
+	got = expandPathTemplate("{albumartist}/{title}", fields, config)
+	if got != "Sigur Ros/Hoppipolla" {
+		t.Errorf("got %q, want %q", got, "Sigur Ros/Hoppipolla")
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Where playlist songs are saved: in their albums' folders, as with album
+// downloads, or together in a folder named after the playlist.
+const (
+	playlistModeAlbum  = "album"
+	playlistModeFolder = "folder"
+)
+
+// Defaults for playlist folders and their .m3u8 files, under dest_dir.
+const (
+	defaultPlaylistsDir           = "Playlists"
+	defaultPlaylistFolderTemplate = "{playlist}/{position:02} - {artist} - {title}"
+)
+
+// playlistDestination returns where the song at position (1-based) of the
+// playlist is saved, following playlist_mode.
+func playlistDestination(playlist resPlaylist, album resAlbum, config configuration, position int) songDestination {
+	fields := map[string]string{
+		"playlist": playlist.Title,
+		"position": strconv.Itoa(position),
+	}
+	if config.PlaylistMode == playlistModeFolder {
+		template := config.PlaylistFolderTemplate
+		if config.PlaylistsDir != "" {
+			template = strings.TrimSuffix(config.PlaylistsDir, "/") + "/" + template
+		}
+		return songDestination{template: template, fields: fields, mixedAlbums: true}
+	}
+	return songDestination{template: songTemplate(album, config, config.PlaylistPathTemplate), fields: fields}
+}
+
+// playlistEntry is one song of a written .m3u8 playlist.
+type playlistEntry struct {
+	path     string
+	duration string
+	artist   string
+	title    string
+}
+
+func newPlaylistEntry(song resSongInfoData, songPath string) playlistEntry {
+	return playlistEntry{
+		path:     songPath,
+		duration: song.Duration,
+		artist:   strings.Join(getArtists(song), ", "),
+		title:    getTitle(song),
+	}
+}
+
+// playlistIdDirective marks an .m3u8 file with the ID of the playlist it was
+// written for, so that playlists sharing a title keep files of their own.
+const playlistIdDirective = "#DEEZER-PLAYLIST:"
+
+// playlistFilePath returns where the .m3u8 file of the playlist is written:
+// it is named after the title, or the ID when there is none, and the ID is
+// added when another playlist's file already has that name.
+func playlistFilePath(playlistId string, playlist resPlaylist, config configuration) string {
+	title := playlist.Title
+	if strings.TrimSpace(title) == "" {
+		title = playlistId
+	}
+	maxBytes := config.MaxNameBytes - len(".m3u8")
+	dir := filepath.Join(config.DestDir, config.PlaylistsDir)
+	m3uPath := filepath.Join(dir, fitPathSegment(title, maxBytes, config.AsciiNames)+".m3u8")
+	if owner := playlistFileOwner(m3uPath); owner == "" || owner == playlistId {
+		return m3uPath
+	}
+	suffix := " (" + playlistId + ")"
+	name := fitPathSegment(title, maxBytes-len(suffix), config.AsciiNames) + suffix
+	return filepath.Join(dir, name+".m3u8")
+}
+
+// playlistFileOwner returns the ID of the playlist the .m3u8 file at m3uPath
+// was written for, or "" when there is no such file or it is not marked.
+func playlistFileOwner(m3uPath string) string {
+	f, err := os.Open(m3uPath)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for i := 0; i < 2 && scanner.Scan(); i++ {
+		if line := scanner.Text(); strings.HasPrefix(line, playlistIdDirective) {
+			return strings.TrimPrefix(line, playlistIdDirective)
+		}
+	}
+	return ""
+}
+
+// writePlaylistFile writes entries, in order, to an extended M3U playlist at
+// m3uPath, with paths relative to the playlist's folder.
+func writePlaylistFile(m3uPath string, playlistId string, entries []playlistEntry) error {
+	dir := filepath.Dir(m3uPath)
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return err
+	}
+
+	var b strings.Builder
+	b.WriteString("#EXTM3U\n")
+	b.WriteString(playlistIdDirective + playlistId + "\n")
+	for _, entry := range entries {
+		relPath, err := filepath.Rel(dir, entry.path)
+		if err != nil {
+			return err
+		}
+		duration, err := strconv.Atoi(entry.duration)
+		if err != nil {
+			duration = -1
+		}
+		fmt.Fprintf(&b, "#EXTINF:%d,%s - %s\n", duration, entry.artist, entry.title)
+		b.WriteString(filepath.ToSlash(relPath) + "\n")
+	}
+	return os.WriteFile(m3uPath, []byte(b.String()), 0644)
+}
+
+// coverCacheDir holds the covers albumCoverCache downloaded during this run.
+// It is created on first use so that a cover changed on Deezer is fetched
+// again by the next run.
+var coverCacheDir string
+
+// albumCoverCache returns the album's cover, downloaded once per album and
+// run, for songs saved in folders shared by many albums.
+func albumCoverCache(album resAlbum) (string, error) {
+	if coverCacheDir == "" {
+		dir, err := os.MkdirTemp("", "deezer-covers-")
+		if err != nil {
+			return "", err
+		}
+		coverCacheDir = dir
+	}
+	coverPath := filepath.Join(coverCacheDir, fmt.Sprintf("%d.jpg", album.ID))
+	if _, err := os.Stat(coverPath); err == nil {
+		return coverPath, nil
+	}
+	if album.CoverXl == "" {
+		return "", fmt.Errorf("album %d has no cover", album.ID)
+	}
+	err := downloadCover(album.CoverXl, coverPath)
+	if err != nil {
+		os.Remove(coverPath)
+		return "", err
+	}
+	return coverPath, nil
+}
+
+// clearCoverCache removes the covers downloaded by albumCoverCache.
+func clearCoverCache() {
+	if coverCacheDir != "" {
+		os.RemoveAll(coverCacheDir)
+		coverCacheDir = ""
+	}
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestPlaylistFilePath(t *testing.T) {
+	config := configuration{
+		DestDir:      t.TempDir(),
+		PlaylistsDir: defaultPlaylistsDir,
+		MaxNameBytes: defaultMaxNameBytes,
+	}
+	dir := filepath.Join(config.DestDir, config.PlaylistsDir)
+	mix := resPlaylist{Title: "Mix"}
+
+	first := playlistFilePath("111", mix, config)
+	if first != filepath.Join(dir, "Mix.m3u8") {
+		t.Fatalf("got %s", first)
+	}
+	if err := writePlaylistFile(first, "111", nil); err != nil {
+		t.Fatal(err)
+	}
+	if got := playlistFilePath("111", mix, config); got != first {
+		t.Errorf("same playlist moved to %s", got)
+	}
+	if got := playlistFilePath("222", mix, config); got != filepath.Join(dir, "Mix (222).m3u8") {
+		t.Errorf("playlist with a taken title got %s", got)
+	}
+	if got := playlistFilePath("333", resPlaylist{}, config); got != filepath.Join(dir, "333.m3u8") {
+		t.Errorf("untitled playlist got %s", got)
+	}
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+// How often the progress line is redrawn on a terminal, and how often a plain
+// progress line is logged otherwise.
+const (
+	progressRedrawInterval = 200 * time.Millisecond
+	progressLogInterval    = 10 * time.Second
+)
+
+func stderrIsTerminal() bool {
+	info, err := os.Stderr.Stat()
+	if err != nil {
+		return false
+	}
+	return info.Mode()&os.ModeCharDevice != 0
+}
+
+// batchProgress follows the tracks of one album or playlist, so that each
+// download can show its position and an estimate for the whole batch.
+type batchProgress struct {
+	total     int
+	completed int
+	start     time.Time
+	tty       bool
+}
+
+func newBatchProgress(total int) *batchProgress {
+	return &batchProgress{
+		total: total,
+		start: time.Now(),
+		tty:   stderrIsTerminal(),
+	}
+}
+
+// track starts reporting the download of the track at position (1-based).
+func (b *batchProgress) track(position int, title string, expected int64) *trackProgress {
+	return &trackProgress{
+		batch:    b,
+		position: position,
+		title:    title,
+		expected: expected,
+		start:    time.Now(),
+		attempt:  time.Now(),
+	}
+}
+
+// trackProgress reports the bytes written for a single download. start is
+// when the track was started, attempt when its current download attempt was.
+type trackProgress struct {
+	batch    *batchProgress
+	position int
+	title    string
+	expected int64
+	written  int64
+	start    time.Time
+	attempt  time.Time
+	lastDraw time.Time
+}
+
+// restart forgets the bytes written so far, for when a download is retried.
+// The speed is measured from then on; the track's start is kept so that the
+// batch estimate still counts the time spent on failed attempts.
+func (p *trackProgress) restart() {
+	if p == nil {
+		return
+	}
+	p.written = 0
+	p.attempt = time.Now()
+}
+
+func (p *trackProgress) add(n int) {
+	if p == nil {
+		return
+	}
+	p.written += int64(n)
+
+	interval := progressLogInterval
+	if p.batch.tty {
+		interval = progressRedrawInterval
+	}
+	if time.Since(p.lastDraw) < interval {
+		return
+	}
+	p.lastDraw = time.Now()
+	if p.batch.tty {
+		fmt.Fprintf(os.Stderr, "\r\033[K%s", p.line())
+	} else {
+		log.Println(p.line())
+	}
+}
+
+// clear removes the progress line once a download attempt has ended.
+func (p *trackProgress) clear() {
+	if p == nil {
+		return
+	}
+	if p.batch.tty {
+		fmt.Fprint(os.Stderr, "\r\033[K")
+	}
+}
+
+// done counts the track as finished, once its download passed the integrity
+// check.
+func (p *trackProgress) done() {
+	if p == nil {
+		return
+	}
+	p.batch.completed++
+}
+
+func (p *trackProgress) line() string {
+	elapsed := time.Since(p.attempt).Seconds()
+	speed := 0.0
+	if elapsed > 0 {
+		speed = float64(p.written) / elapsed
+	}
+
+	parts := []string{fmt.Sprintf("[%03d/%03d] %s", p.position, p.batch.total, p.title)}
+	if p.expected > 0 {
+		parts = append(parts, fmt.Sprintf("%s / %s (%d%%)", formatBytes(p.written), formatBytes(p.expected),
+			p.written*100/p.expected))
+	} else {
+		parts = append(parts, formatBytes(p.written))
+	}
+	parts = append(parts, formatBytes(int64(speed))+"/s")
+	if eta, ok := p.eta(speed); ok {
+		parts = append(parts, "ETA "+eta.Round(time.Second).String())
+	}
+	return strings.Join(parts, "  ")
+}
+
+// eta estimates the time left for the whole batch: what remains of this
+// track at the current speed, plus the remaining tracks at the average time
+// the finished ones took.
+func (p *trackProgress) eta(speed float64) (time.Duration, bool) {
+	if p.expected <= 0 || speed <= 0 {
+		return 0, false
+	}
+	remainingBytes := p.expected - p.written
+	if remainingBytes < 0 {
+		remainingBytes = 0
+	}
+	current := time.Duration(float64(remainingBytes) / speed * float64(time.Second))
+
+	perTrack := time.Duration(float64(p.expected) / speed * float64(time.Second))
+	if p.batch.completed > 0 {
+		perTrack = p.start.Sub(p.batch.start) / time.Duration(p.batch.completed)
+	}
+	return current + perTrack*time.Duration(p.batch.total-p.position), true
+}
+
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
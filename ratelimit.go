@@ -0,0 +1,139 @@
+package main
+
+import (
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+// tokenBucket allows bursts of up to capacity tokens, refilled evenly over
+// window. It is safe for concurrent use.
+type tokenBucket struct {
+	mu          sync.Mutex
+	capacity    float64
+	window      time.Duration
+	tokens      float64
+	last        time.Time
+	pausedUntil time.Time
+}
+
+func newTokenBucket(capacity float64, window time.Duration) *tokenBucket {
+	return &tokenBucket{
+		capacity: capacity,
+		window:   window,
+		tokens:   capacity,
+		last:     time.Now(),
+	}
+}
+
+// wait blocks until n tokens are available and takes them. n must not be
+// larger than the bucket's capacity.
+func (b *tokenBucket) wait(n float64) {
+	for {
+		b.mu.Lock()
+		now := time.Now()
+		if now.Before(b.pausedUntil) {
+			delay := b.pausedUntil.Sub(now)
+			b.mu.Unlock()
+			time.Sleep(delay)
+			continue
+		}
+		rate := b.capacity / b.window.Seconds()
+		b.tokens += now.Sub(b.last).Seconds() * rate
+		if b.tokens > b.capacity {
+			b.tokens = b.capacity
+		}
+		b.last = now
+		if b.tokens >= n {
+			b.tokens -= n
+			b.mu.Unlock()
+			return
+		}
+		delay := time.Duration((n - b.tokens) / rate * float64(time.Second))
+		b.mu.Unlock()
+		time.Sleep(delay)
+	}
+}
+
+// pause empties the bucket and holds every caller for a full window. It is
+// used when the server reports that the quota has been exceeded anyway.
+func (b *tokenBucket) pause() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.tokens = 0
+	b.last = time.Now()
+	b.pausedUntil = b.last.Add(b.window)
+}
+
+var (
+	hostLimitersMu sync.Mutex
+	hostLimiters   = make(map[string]*tokenBucket)
+)
+
+func isCdnHost(host string) bool {
+	return strings.HasSuffix(host, ".dzcdn.net")
+}
+
+// limiterFor returns the request limiter for host, creating it from the
+// config on first use. It returns nil when requests to host are unlimited.
+func limiterFor(host string, config configuration) *tokenBucket {
+	hostLimitersMu.Lock()
+	defer hostLimitersMu.Unlock()
+
+	if b, ok := hostLimiters[host]; ok {
+		return b
+	}
+	requests, window := config.RateLimit.Requests, config.RateLimit.WindowSeconds
+	if isCdnHost(host) {
+		requests, window = config.RateLimit.CdnRequests, config.RateLimit.CdnWindowSeconds
+	}
+	var b *tokenBucket
+	if requests > 0 && window > 0 {
+		b = newTokenBucket(float64(requests), time.Duration(window*float64(time.Second)))
+	}
+	hostLimiters[host] = b
+	return b
+}
+
+// pauseHost holds further requests to host for a full quota window.
+func pauseHost(host string) {
+	hostLimitersMu.Lock()
+	b := hostLimiters[host]
+	hostLimitersMu.Unlock()
+	if b != nil {
+		b.pause()
+	}
+}
+
+// bandwidthLimiter caps the combined speed of all media downloads. It is nil
+// when no limit is set.
+var bandwidthLimiter *tokenBucket
+
+// setBandwidthLimit sets the shared download cap in bytes per second; zero
+// removes it.
+func setBandwidthLimit(bytesPerSecond int64) {
+	if bytesPerSecond <= 0 {
+		bandwidthLimiter = nil
+		return
+	}
+	bandwidthLimiter = newTokenBucket(float64(bytesPerSecond), time.Second)
+}
+
+// throttledReader takes a token per byte read from the limiter, so every
+// reader sharing a limiter shares its bandwidth.
+type throttledReader struct {
+	r       io.Reader
+	limiter *tokenBucket
+}
+
+func (t throttledReader) Read(p []byte) (int, error) {
+	if max := int(t.limiter.capacity); len(p) > max {
+		p = p[:max]
+	}
+	n, err := t.r.Read(p)
+	if n > 0 {
+		t.limiter.wait(float64(n))
+	}
+	return n, err
+}
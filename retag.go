@@ -0,0 +1,231 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	id3v2 "github.com/bogem/id3v2"
+	"github.com/go-flac/go-flac"
+)
+
+// sourceTags are the identifying tags read back from an existing file; each
+// is "" when the file does not carry it.
+type sourceTags struct {
+	trackId string
+	isrc    string
+	format  string
+}
+
+func readSourceTags(path string) sourceTags {
+	var tags sourceTags
+	if strings.ToLower(filepath.Ext(path)) == ".flac" {
+		file, err := os.Open(path)
+		if err != nil {
+			return tags
+		}
+		defer file.Close()
+		f, err := flac.ParseMetadata(file)
+		if err != nil {
+			return tags
+		}
+		cmts, _, err := extractFlacComment(f)
+		if err != nil || cmts == nil {
+			return tags
+		}
+		if values, _ := cmts.Get("DEEZER_TRACKID"); len(values) > 0 {
+			tags.trackId = values[0]
+		}
+		if values, _ := cmts.Get("ISRC"); len(values) > 0 {
+			tags.isrc = values[0]
+		}
+		if values, _ := cmts.Get("DEEZER_FORMAT"); len(values) > 0 {
+			tags.format = values[0]
+		}
+		return tags
+	}
+
+	tag, err := id3v2.Open(path, id3v2.Options{Parse: true})
+	if err != nil {
+		return tags
+	}
+	defer tag.Close()
+	for _, frame := range tag.GetFrames(tag.CommonID("User defined text information frame")) {
+		udtf, ok := frame.(id3v2.UserDefinedTextFrame)
+		if !ok {
+			continue
+		}
+		switch udtf.Description {
+		case "DEEZER_TRACKID":
+			tags.trackId = udtf.Value
+		case "DEEZER_FORMAT":
+			tags.format = udtf.Value
+		}
+	}
+	tags.isrc = tag.GetTextFrame("TSRC").Text
+	return tags
+}
+
+// resolveTrackId finds the Deezer track ID of an existing file: from its
+// folder's manifest, from its DEEZER_TRACKID tag, or by looking its ISRC up.
+func resolveTrackId(path string, manifest dirManifest, config configuration) (int64, error) {
+	if entry, ok := manifest[filepath.Base(path)]; ok && entry.TrackId != "" {
+		return strconv.ParseInt(entry.TrackId, 10, 64)
+	}
+	tags := readSourceTags(path)
+	if tags.trackId != "" {
+		return strconv.ParseInt(tags.trackId, 10, 64)
+	}
+	isrc := tags.isrc
+	if isrc == "" {
+		return 0, errors.New("no Deezer track ID recorded or tagged and no ISRC tag")
+	}
+	var track resTrack
+	err := retryOnQuota(func() error {
+		var err error
+		track, err = getTrackByIsrc(isrc, config)
+		return err
+	})
+	if err != nil {
+		return 0, fmt.Errorf("error looking up ISRC %s: %w", isrc, err)
+	}
+	return track.Id, nil
+}
+
+// processRetag re-fetches the metadata of every song under the library, or
+// the folder given as argument, and rewrites its tags and cover in place
+// without downloading the audio again.
+func processRetag(args []string, config configuration, logFile *os.File) {
+	root := config.DestDir
+	if len(args) > 0 {
+		root = args[0]
+	}
+
+	var paths []string
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		ext := strings.ToLower(filepath.Ext(path))
+		if !d.IsDir() && (ext == ".flac" || ext == ".mp3") {
+			paths = append(paths, path)
+		}
+		return nil
+	})
+	if err != nil {
+		log.Fatalf("error walking %s: %s\n", root, err)
+	}
+
+	albums := make(map[string]resAlbum)
+	refreshedCovers := make(map[string]bool)
+	failed := 0
+	for idx, path := range paths {
+		log.Printf("[%03d/%03d] Retagging %s\n", idx+1, len(paths), path)
+		err := retagFile(path, config, albums, refreshedCovers)
+		if err != nil {
+			failed++
+			msg := fmt.Sprintf("Retag failed: %s: %s\n", path, err)
+			log.Print(msg)
+			logFile.Write([]byte(msg))
+		}
+	}
+	msg := fmt.Sprintf("Retagged %d of %d files\n", len(paths)-failed, len(paths))
+	log.Print(msg)
+	logFile.Write([]byte(msg))
+}
+
+func retagFile(path string, config configuration, albums map[string]resAlbum, refreshedCovers map[string]bool) error {
+	dir := filepath.Dir(path)
+	manifest, err := readManifest(dir)
+	if err != nil {
+		return err
+	}
+	trackId, err := resolveTrackId(path, manifest, config)
+	if err != nil {
+		return err
+	}
+
+	songInfo, err := getSongInfo(trackId, config)
+	if err != nil {
+		return fmt.Errorf("error getting song info: %w", err)
+	}
+	song := songInfo.Data
+
+	album, ok := albums[song.AlbId]
+	if !ok {
+		err = retryOnQuota(func() error {
+			var err error
+			album, err = getAlbum(song.AlbId, config)
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("error getting album: %w", err)
+		}
+		err = loadAlbumDetails(&album, config)
+		if err != nil {
+			return fmt.Errorf("error getting album songs: %w", err)
+		}
+		albums[song.AlbId] = album
+	}
+
+	// Folders shared by many albums, such as playlist folders, get no
+	// cover.jpg, so each song's cover comes from its own album
+	var coverFilePath string
+	if mixedAlbumDir(manifest) {
+		coverFilePath, err = albumCoverCache(album)
+		if err != nil {
+			return err
+		}
+	} else {
+		coverFilePath = filepath.Join(dir, "cover.jpg")
+		if !refreshedCovers[dir] && album.CoverXl != "" {
+			err = downloadCover(album.CoverXl, coverFilePath)
+			if err != nil {
+				return err
+			}
+			refreshedCovers[dir] = true
+		}
+	}
+
+	format := manifest[filepath.Base(path)].Format
+	if format == "" {
+		format = readSourceTags(path).format
+	}
+	if format == "" {
+		format = "MP3"
+		if strings.ToLower(filepath.Ext(path)) == ".flac" {
+			format = "FLAC"
+		}
+	}
+
+	err = tagSong(song, album, path, format, coverFilePath, config)
+	if err != nil {
+		return err
+	}
+	// Only files recorded at download time get their checksum refreshed: a
+	// checksum taken now would vouch for audio that was never verified
+	if _, ok := manifest[filepath.Base(path)]; !ok {
+		return nil
+	}
+	return recordInManifest(path, song.SngId, song.AlbId, format)
+}
+
+// mixedAlbumDir reports whether the manifest records songs of more than one
+// album.
+func mixedAlbumDir(manifest dirManifest) bool {
+	albumId := ""
+	for _, entry := range manifest {
+		if albumId != "" && entry.AlbumId != "" && entry.AlbumId != albumId {
+			return true
+		}
+		if entry.AlbumId != "" {
+			albumId = entry.AlbumId
+		}
+	}
+	return false
+}
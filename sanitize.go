@@ -0,0 +1,104 @@
+package main
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// defaultMaxNameBytes is the longest file or folder name most filesystems,
+// SMB shares included, accept.
+const defaultMaxNameBytes = 255
+
+// windowsReservedNames cannot be used as a file name on Windows, whatever the
+// extension.
+var windowsReservedNames = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true,
+	"COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true,
+	"COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true,
+	"LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+}
+
+// asciiLetters are the transliterations of letters that do not decompose
+// into an ASCII letter and combining marks.
+var asciiLetters = map[rune]string{
+	'ß': "ss", 'æ': "ae", 'Æ': "AE", 'œ': "oe", 'Œ': "OE", 'ø': "o", 'Ø': "O",
+	'đ': "d", 'Đ': "D", 'ł': "l", 'Ł': "L", 'þ': "th", 'Þ': "Th", 'ð': "d",
+	'Ð': "D", 'ı': "i", '‘': "'", '’': "'", '“': "\"", '”': "\"", '–': "-",
+	'—': "-", '…': "...",
+}
+
+// SanitizePath replaces the characters that are not allowed in a file or
+// folder name on Windows, macOS or Linux, path separators included, and turns
+// control characters into spaces.
+func SanitizePath(rawPath string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case strings.ContainsRune(`<>:"/\|?*`, r):
+			return '-'
+		case unicode.IsControl(r):
+			return ' '
+		}
+		return r
+	}, rawPath)
+}
+
+// fitPathSegment makes name usable as a single file or folder name on every
+// platform: it is normalised to NFC (or transliterated to ASCII), stripped of
+// leading dots and trailing dots and spaces, kept clear of Windows reserved
+// names and cut to maxBytes without splitting a character.
+func fitPathSegment(name string, maxBytes int, ascii bool) string {
+	name = norm.NFC.String(name)
+	if ascii {
+		name = transliterate(name)
+	}
+	name = SanitizePath(name)
+	name = strings.TrimLeft(name, ". ")
+	name = truncateBytes(name, maxBytes)
+	name = strings.TrimRight(name, ". ")
+
+	base := name
+	if i := strings.IndexByte(base, '.'); i >= 0 {
+		base = base[:i]
+	}
+	if windowsReservedNames[strings.ToUpper(strings.TrimSpace(base))] {
+		name = truncateBytes("_"+name, maxBytes)
+	}
+	if name == "" {
+		name = "_"
+	}
+	return name
+}
+
+// truncateBytes cuts s to at most maxBytes bytes on a character boundary.
+func truncateBytes(s string, maxBytes int) string {
+	if maxBytes <= 0 || len(s) <= maxBytes {
+		return s
+	}
+	end := maxBytes
+	for end > 0 && !utf8.RuneStart(s[end]) {
+		end--
+	}
+	return s[:end]
+}
+
+// transliterate approximates s in ASCII: accents are dropped, a few letters
+// are spelt out and anything else outside ASCII becomes an underscore.
+func transliterate(s string) string {
+	var b strings.Builder
+	for _, r := range norm.NFD.String(s) {
+		switch {
+		case r < utf8.RuneSelf:
+			b.WriteRune(r)
+		case unicode.Is(unicode.Mn, r):
+		case asciiLetters[r] != "":
+			b.WriteString(asciiLetters[r])
+		default:
+			b.WriteByte('_')
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestFitPathSegment(t *testing.T) {
+	tests := []struct {
+		name     string
+		maxBytes int
+		ascii    bool
+		want     string
+	}{
+		{"Hells Bells", 255, false, "Hells Bells"},
+		{"What? Why: \"Now\"", 255, false, "What- Why- -Now-"},
+		{"Tab\there", 255, false, "Tab here"},
+		{"..hidden", 255, false, "hidden"},
+		{"Trailing. . ", 255, false, "Trailing"},
+		{"CON", 255, false, "_CON"},
+		{"nul.txt", 255, false, "_nul.txt"},
+		{"Console", 255, false, "Console"},
+		{"...", 255, false, "_"},
+		{"", 255, false, "_"},
+		// "é" written as "e" and a combining acute accent
+		{"Cafe\u0301", 255, false, "Caf\u00e9"},
+		{"Sigur Rós", 255, true, "Sigur Ros"},
+		{"Straße Œuvre", 255, true, "Strasse OEuvre"},
+		{"“Quoted”", 255, true, "-Quoted-"},
+		{"日本", 255, true, "__"},
+		{"abcdef", 4, false, "abcd"},
+		{"abc. def", 5, false, "abc"},
+	}
+	for _, test := range tests {
+		got := fitPathSegment(test.name, test.maxBytes, test.ascii)
+		if got != test.want {
+			t.Errorf("fitPathSegment(%q, %d, %v) = %q, want %q",
+				test.name, test.maxBytes, test.ascii, got, test.want)
+		}
+	}
+}
+
+func TestFitPathSegmentKeepsCharactersWhole(t *testing.T) {
+	name := strings.Repeat("日", 100)
+	for maxBytes := 1; maxBytes <= 20; maxBytes++ {
+		got := fitPathSegment(name, maxBytes, false)
+		if !utf8.ValidString(got) {
+			t.Errorf("maxBytes %d: %q is not valid UTF-8", maxBytes, got)
+		}
+		if len(got) > maxBytes {
+			t.Errorf("maxBytes %d: %q is %d bytes", maxBytes, got, len(got))
+		}
+	}
+}
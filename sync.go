@@ -0,0 +1,385 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// What playlist sync does with the files of tracks removed from a playlist.
+const (
+	syncRemovedKeep    = "keep"
+	syncRemovedDelete  = "delete"
+	syncRemovedArchive = "archive"
+)
+
+const defaultArchiveDir = "Archive"
+
+// playlistSyncState is what the last sync of a playlist downloaded, kept
+// next to its .m3u8 file.
+type playlistSyncState struct {
+	PlaylistId string        `json:"playlist_id"`
+	Title      string        `json:"title"`
+	SyncedAt   time.Time     `json:"synced_at"`
+	Tracks     []syncedTrack `json:"tracks"`
+}
+
+// syncedTrack is one song of a synced playlist. Path is relative to dest_dir.
+type syncedTrack struct {
+	TrackId  string `json:"track_id"`
+	AlbumId  string `json:"album_id"`
+	Path     string `json:"path"`
+	Duration string `json:"duration"`
+	Artist   string `json:"artist"`
+	Title    string `json:"title"`
+}
+
+func (t syncedTrack) entry(config configuration) playlistEntry {
+	return playlistEntry{
+		path:     filepath.Join(config.DestDir, filepath.FromSlash(t.Path)),
+		duration: t.Duration,
+		artist:   t.Artist,
+		title:    t.Title,
+	}
+}
+
+func syncStatePath(playlistId string, config configuration) string {
+	return filepath.Join(config.DestDir, config.PlaylistsDir, ".deezer-sync-"+playlistId+".json")
+}
+
+// readSyncState returns the state of the playlist's last sync, which is empty
+// when it was never synced.
+func readSyncState(playlistId string, config configuration) (playlistSyncState, error) {
+	state := playlistSyncState{PlaylistId: playlistId}
+	data, err := os.ReadFile(syncStatePath(playlistId, config))
+	if errors.Is(err, os.ErrNotExist) {
+		return state, nil
+	}
+	if err != nil {
+		return state, err
+	}
+	err = json.Unmarshal(data, &state)
+	return state, err
+}
+
+func writeSyncState(state playlistSyncState, config configuration) error {
+	statePath := syncStatePath(state.PlaylistId, config)
+	err := os.MkdirAll(filepath.Dir(statePath), 0755)
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(statePath, data, 0644)
+}
+
+// processPlaylistSync syncs every playlist given as argument. With --removed,
+// the files of tracks removed from a playlist are kept, deleted or archived,
+// overriding sync_removed.
+func processPlaylistSync(args []string, config configuration, logFile *os.File) {
+	flags := flag.NewFlagSet("playlist sync", flag.ContinueOnError)
+	flags.Usage = printUsage
+	removed := flags.String("removed", config.SyncRemoved, "")
+	if err := flags.Parse(args); err != nil {
+		return
+	}
+	if flags.NArg() == 0 {
+		printUsage()
+		return
+	}
+	if err := checkSyncRemoved(*removed); err != nil {
+		log.Fatalf("invalid --removed: %s\n", err)
+	}
+	config.SyncRemoved = *removed
+
+	for idx, playlistId := range flags.Args() {
+		log.Printf("[%03d/%03d] Syncing playlist %s\n", idx+1, flags.NArg(), playlistId)
+		err := syncPlaylist(playlistId, config, logFile)
+		if err != nil {
+			log.Fatalf("%s%s\n", err, errorHint(err))
+		}
+	}
+}
+
+func checkSyncRemoved(removed string) error {
+	switch removed {
+	case syncRemovedKeep, syncRemovedDelete, syncRemovedArchive:
+		return nil
+	}
+	return fmt.Errorf("%q is not \"keep\", \"delete\" or \"archive\"", removed)
+}
+
+// syncPlaylist brings a playlist's local copy in line with Deezer: tracks the
+// last sync did not download are downloaded, tracks removed from the playlist
+// are handled as sync_removed says, and the .m3u8 file is rewritten in the
+// playlist's current order. Songs that are unavailable are skipped, and tried
+// again on the next sync.
+func syncPlaylist(playlistId string, config configuration, logFile *os.File) error {
+	playlist, tracks, err := listPlaylist(playlistId, config, logFile)
+	if err != nil {
+		return err
+	}
+	return syncTracks(playlistId, playlist, tracks, config, logFile)
+}
+
+// syncTracks is syncPlaylist for a list of tracks that has already been
+// fetched; playlistId names its sync state.
+func syncTracks(playlistId string, playlist resPlaylist, tracks resTracks, config configuration, logFile *os.File) error {
+	state, err := readSyncState(playlistId, config)
+	if err != nil {
+		return fmt.Errorf("error reading sync state of playlist %s: %w", playlistId, err)
+	}
+
+	known := make(map[string]syncedTrack)
+	for _, t := range state.Tracks {
+		_, err := os.Stat(filepath.Join(config.DestDir, filepath.FromSlash(t.Path)))
+		if err == nil {
+			known[t.TrackId] = t
+		}
+	}
+	newCount := 0
+	inPlaylist := make(map[string]bool)
+	for _, track := range tracks.Data {
+		trackId := strconv.FormatInt(track.Id, 10)
+		if _, ok := known[trackId]; !ok && !inPlaylist[trackId] {
+			newCount++
+		}
+		inPlaylist[trackId] = true
+	}
+
+	var synced []syncedTrack
+	batch := newBatchProgress(newCount)
+	downloaded := 0
+	for i, track := range tracks.Data {
+		trackId := strconv.FormatInt(track.Id, 10)
+		if t, ok := known[trackId]; ok {
+			synced = append(synced, t)
+			continue
+		}
+
+		song, album, err := fetchPlaylistSong(track, config)
+		if isUnavailable(err) {
+			msg := fmt.Sprintf("skipping \"%s\" by %s: %s\n", track.Title, track.Artist.Name, err)
+			log.Print(msg)
+			logFile.Write([]byte(msg))
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		dest := playlistDestination(playlist, album, config, i+1)
+		songPath, err := downloadTrack(song, album, config, dest, batch, downloaded+1)
+		if errors.Is(err, errNoFormats) {
+			msg := fmt.Sprintf("skipping \"%s\" by %s: no available formats\n", song.SngTitle, song.ArtName)
+			log.Print(msg)
+			logFile.Write([]byte(msg))
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		downloaded++
+
+		relPath, err := filepath.Rel(config.DestDir, songPath)
+		if err != nil {
+			return err
+		}
+		entry := newPlaylistEntry(song, songPath)
+		t := syncedTrack{
+			TrackId:  trackId,
+			AlbumId:  song.AlbId,
+			Path:     filepath.ToSlash(relPath),
+			Duration: entry.duration,
+			Artist:   entry.artist,
+			Title:    entry.title,
+		}
+		known[trackId] = t
+		synced = append(synced, t)
+	}
+
+	// A track missing from a partial listing has not necessarily been
+	// removed, so nothing is removed until a full listing is had; the
+	// unlisted tracks stay in the sync state meanwhile
+	complete := listingComplete(playlist, tracks)
+	if !complete {
+		msg := fmt.Sprintf("warning: only %d tracks of playlist %s could be listed, not handling removed tracks\n",
+			len(tracks.Data), playlistId)
+		log.Print(msg)
+		logFile.Write([]byte(msg))
+	}
+	var otherPaths map[string]bool
+	if complete && config.SyncRemoved != syncRemovedKeep {
+		otherPaths, err = otherSyncedPaths(playlistId, config)
+		if err != nil {
+			return err
+		}
+	}
+	removed := 0
+	var unlisted []syncedTrack
+	stillUsed := make(map[string]bool)
+	for _, t := range synced {
+		stillUsed[t.Path] = true
+	}
+	for _, t := range state.Tracks {
+		if inPlaylist[t.TrackId] || stillUsed[t.Path] {
+			continue
+		}
+		stillUsed[t.Path] = true
+		if !complete {
+			unlisted = append(unlisted, t)
+			continue
+		}
+		removed++
+		err = handleRemovedTrack(t, otherPaths, config)
+		if err != nil {
+			msg := fmt.Sprintf("error removing %s: %s\n", t.Path, err)
+			log.Print(msg)
+			logFile.Write([]byte(msg))
+		}
+	}
+
+	m3uPath := playlistFilePath(playlistId, playlist, config)
+	if state.Title != "" {
+		// The playlist was renamed: its old file goes, unless it was written
+		// for another playlist
+		oldPath := playlistFilePath(playlistId, resPlaylist{Title: state.Title}, config)
+		if oldPath != m3uPath && playlistFileOwner(oldPath) == playlistId {
+			os.Remove(oldPath)
+		}
+	}
+	entries := make([]playlistEntry, 0, len(synced))
+	for _, t := range synced {
+		entries = append(entries, t.entry(config))
+	}
+	err = writePlaylistFile(m3uPath, playlistId, entries)
+	if err != nil {
+		return fmt.Errorf("error writing playlist file %s: %w", m3uPath, err)
+	}
+
+	state.Title = playlist.Title
+	state.SyncedAt = time.Now()
+	state.Tracks = append(synced, unlisted...)
+	err = writeSyncState(state, config)
+	if err != nil {
+		return fmt.Errorf("error writing sync state of playlist %s: %w", playlistId, err)
+	}
+
+	msg := fmt.Sprintf("Playlist sync succeeded: %s (%d new, %d removed, %d unchanged)\n",
+		playlistId, downloaded, removed, len(synced)-downloaded)
+	log.Print(msg)
+	logFile.Write([]byte(msg))
+	return nil
+}
+
+// listingComplete reports whether tracks holds every track the playlist
+// declares. An empty listing never counts as complete.
+func listingComplete(playlist resPlaylist, tracks resTracks) bool {
+	declared := playlist.NbTracks
+	if declared == 0 {
+		declared = tracks.Total
+	}
+	return len(tracks.Data) > 0 && len(tracks.Data) >= declared
+}
+
+// otherSyncedPaths returns the paths, relative to dest_dir, recorded by the
+// sync states of every playlist but playlistId.
+func otherSyncedPaths(playlistId string, config configuration) (map[string]bool, error) {
+	paths := make(map[string]bool)
+	dir := filepath.Join(config.DestDir, config.PlaylistsDir)
+	files, err := os.ReadDir(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return paths, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range files {
+		name := file.Name()
+		if !strings.HasPrefix(name, ".deezer-sync-") || !strings.HasSuffix(name, ".json") {
+			continue
+		}
+		otherId := strings.TrimSuffix(strings.TrimPrefix(name, ".deezer-sync-"), ".json")
+		if otherId == playlistId {
+			continue
+		}
+		state, err := readSyncState(otherId, config)
+		if err != nil {
+			return nil, fmt.Errorf("error reading %s: %w", name, err)
+		}
+		for _, t := range state.Tracks {
+			paths[t.Path] = true
+		}
+	}
+	return paths, nil
+}
+
+// inPlaylistsDir reports whether a path relative to dest_dir lies in
+// playlists_dir, where only playlist folders are saved.
+func inPlaylistsDir(relPath string, config configuration) bool {
+	if config.PlaylistsDir == "" {
+		return false
+	}
+	dir := filepath.ToSlash(filepath.Clean(config.PlaylistsDir))
+	return strings.HasPrefix(relPath, dir+"/")
+}
+
+// handleRemovedTrack keeps, deletes or archives the file of a track that was
+// removed from its playlist, along with its .lrc sidecar. Archived files keep
+// their path under archive_dir. Files in the album tree, which album
+// downloads share, and files another synced playlist still uses are always
+// kept.
+func handleRemovedTrack(t syncedTrack, otherPaths map[string]bool, config configuration) error {
+	if config.SyncRemoved == syncRemovedKeep {
+		return nil
+	}
+	if !inPlaylistsDir(t.Path, config) {
+		log.Printf("Keeping %s, removed from the playlist: it is in the album tree\n", t.Path)
+		return nil
+	}
+	if otherPaths[t.Path] {
+		log.Printf("Keeping %s, removed from the playlist: another synced playlist uses it\n", t.Path)
+		return nil
+	}
+
+	songPath := filepath.Join(config.DestDir, filepath.FromSlash(t.Path))
+	switch config.SyncRemoved {
+	case syncRemovedDelete:
+		log.Printf("Deleting %s, removed from the playlist\n", t.Path)
+		err := os.Remove(songPath)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		err = os.Remove(lrcPath(songPath))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		return forgetInManifest(songPath)
+	case syncRemovedArchive:
+		archivePath := filepath.Join(config.DestDir, config.ArchiveDir, filepath.FromSlash(t.Path))
+		log.Printf("Archiving %s, removed from the playlist\n", t.Path)
+		err := os.MkdirAll(filepath.Dir(archivePath), 0755)
+		if err != nil {
+			return err
+		}
+		err = os.Rename(songPath, archivePath)
+		if err != nil {
+			return err
+		}
+		err = os.Rename(lrcPath(songPath), lrcPath(archivePath))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		return moveInManifest(songPath, archivePath)
+	}
+	return nil
+}
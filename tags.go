@@ -2,7 +2,9 @@ package main
 
 import (
 	"os"
+	"sort"
 	"strconv"
+	"strings"
 
 	id3v2 "github.com/bogem/id3v2"
 	"github.com/go-flac/flacpicture"
@@ -10,22 +12,44 @@ import (
 	"github.com/go-flac/go-flac"
 )
 
+// extractFlacComment returns the file's Vorbis comment block and its index
+// in f.Meta, or nil and -1 when the file has none.
 func extractFlacComment(f *flac.File) (*flacvorbis.MetaDataBlockVorbisComment, int, error) {
 	var err error
 	var cmt *flacvorbis.MetaDataBlockVorbisComment
-	var cmtIdx int
+	cmtIdx := -1
 	for idx, meta := range f.Meta {
 		if meta.Type == flac.VorbisComment {
 			cmt, err = flacvorbis.ParseFromMetaDataBlock(*meta)
 			cmtIdx = idx
 			if err != nil {
-				return nil, 0, err
+				return nil, -1, err
 			}
 		}
 	}
 	return cmt, cmtIdx, nil
 }
 
+// setVorbisComment replaces every value of key with the given values.
+// Empty values are dropped, so passing none just removes the field.
+func setVorbisComment(cmts *flacvorbis.MetaDataBlockVorbisComment, key string, values ...string) {
+	kept := cmts.Comments[:0]
+	for _, cmt := range cmts.Comments {
+		name, _, _ := strings.Cut(cmt, "=")
+		if !strings.EqualFold(name, key) {
+			kept = append(kept, cmt)
+		}
+	}
+	cmts.Comments = kept
+	for _, value := range values {
+		if value != "" {
+			cmts.Add(key, value)
+		}
+	}
+}
+
+// addCover embeds the cover as the file's front cover, replacing any front
+// cover embedded before.
 func addCover(songPath string, coverPath string) error {
 	coverData, err := os.ReadFile(coverPath)
 	if err != nil {
@@ -43,14 +67,157 @@ func addCover(songPath string, coverPath string) error {
 		return err
 	}
 
+	meta := f.Meta[:0]
+	for _, block := range f.Meta {
+		if block.Type == flac.Picture {
+			existing, err := flacpicture.ParseFromMetaDataBlock(*block)
+			if err == nil && existing.PictureType == flacpicture.PictureTypeFrontCover {
+				continue
+			}
+		}
+		meta = append(meta, block)
+	}
+	f.Meta = meta
+
 	picturemeta := picture.Marshal()
 	f.Meta = append(f.Meta, &picturemeta)
-	f.Save(songPath)
-	return nil
+	return f.Save(songPath)
+}
+
+type tagField struct {
+	key   string
+	value string
+}
+
+// sourceFields are the tags recording where a file came from, so that later
+// retagging, verification and dedup can key off stable IDs. They are written
+// as Vorbis comments and ID3 TXXX frames under the same names.
+func sourceFields(song resSongInfoData, album resAlbum, format string) []tagField {
+	albumId := song.AlbId
+	if albumId == "" && album.ID != 0 {
+		albumId = strconv.Itoa(album.ID)
+	}
+	return []tagField{
+		{"DEEZER_TRACKID", song.SngId},
+		{"DEEZER_ALBUMID", albumId},
+		{"DEEZER_ARTISTID", song.ArtId},
+		{"UPC", album.Upc},
+		{"LABEL", album.Label},
+		{"DEEZER_FORMAT", format},
+	}
+}
+
+// creditRole says where the names Deezer lists under a contributor role are
+// written: a Vorbis comment field, and the ID3 frame TEXT (lyricists), TIPL
+// (involved people) or TMCL (musicians). label names the role in TIPL/TMCL
+// pairs and PERFORMER values.
+type creditRole struct {
+	vorbis string
+	id3    string
+	label  string
+}
+
+// creditRoles maps Deezer's contributor roles to tags. Roles not listed here
+// are credited as performers under their Deezer name; main_artist and
+// composer already have their own tags.
+var creditRoles = map[string]creditRole{
+	"author":          {"LYRICIST", "TEXT", ""},
+	"lyricist":        {"LYRICIST", "TEXT", ""},
+	"writer":          {"LYRICIST", "TEXT", ""},
+	"producer":        {"PRODUCER", "TIPL", "producer"},
+	"co-producer":     {"PRODUCER", "TIPL", "co-producer"},
+	"mixer":           {"MIXER", "TIPL", "mix"},
+	"engineer":        {"ENGINEER", "TIPL", "engineer"},
+	"arranger":        {"ARRANGER", "TIPL", "arranger"},
+	"musicpublisher":  {"PUBLISHER", "TIPL", "publisher"},
+	"music_publisher": {"PUBLISHER", "TIPL", "publisher"},
+	"featuring":       {"PERFORMER", "TMCL", "featuring"},
+}
+
+// creditVorbisFields lists every field credits are written to, so that stale
+// values are cleared when a song is retagged.
+var creditVorbisFields = []string{"LYRICIST", "PRODUCER", "MIXER", "ENGINEER", "ARRANGER", "PUBLISHER", "PERFORMER"}
+
+// getCreditTags sorts the song's credits into Vorbis fields and ID3 frames.
+// ID3 values are already joined into the frame's null-separated text.
+func getCreditTags(song resSongInfoData) (map[string][]string, map[string]string) {
+	credits := getCredits(song)
+	roles := make([]string, 0, len(credits))
+	for role := range credits {
+		if role != "main_artist" && role != "composer" {
+			roles = append(roles, role)
+		}
+	}
+	sort.Strings(roles)
+
+	vorbis := make(map[string][]string)
+	id3Values := make(map[string][]string)
+	for _, role := range roles {
+		mapping, ok := creditRoles[role]
+		if !ok {
+			mapping = creditRole{"PERFORMER", "TMCL", strings.ReplaceAll(role, "_", " ")}
+		}
+		for _, name := range credits[role] {
+			if mapping.vorbis == "PERFORMER" {
+				vorbis["PERFORMER"] = append(vorbis["PERFORMER"], name+" ("+mapping.label+")")
+			} else {
+				vorbis[mapping.vorbis] = append(vorbis[mapping.vorbis], name)
+			}
+			if mapping.id3 == "TEXT" {
+				id3Values["TEXT"] = append(id3Values["TEXT"], name)
+			} else {
+				id3Values[mapping.id3] = append(id3Values[mapping.id3], mapping.label, name)
+			}
+		}
+	}
+
+	id3 := make(map[string]string, len(id3Values))
+	for frame, values := range id3Values {
+		id3[frame] = strings.Join(values, "\x00")
+	}
+	return vorbis, id3
+}
+
+// replayGainFields are the ReplayGain tags derived from Deezer's gain data,
+// written as Vorbis comments and ID3 TXXX frames.
+func replayGainFields(song resSongInfoData, album resAlbum) []tagField {
+	return []tagField{
+		{"REPLAYGAIN_TRACK_GAIN", getTrackGain(song)},
+		{"REPLAYGAIN_ALBUM_GAIN", album.ReplayGain},
+	}
+}
+
+// setID3TextFrame sets the text frame id to value, or removes it when value is
+// empty.
+func setID3TextFrame(tag *id3v2.Tag, id string, value string) {
+	if value == "" {
+		tag.DeleteFrames(id)
+		return
+	}
+	tag.AddTextFrame(id, tag.DefaultEncoding(), value)
+}
+
+// deleteUserDefinedTextFrames removes every TXXX frame whose description is
+// one of descriptions.
+func deleteUserDefinedTextFrames(tag *id3v2.Tag, descriptions ...string) {
+	remove := make(map[string]bool)
+	for _, description := range descriptions {
+		remove[description] = true
+	}
+	id := tag.CommonID("User defined text information frame")
+	// The tag reuses the frame list once the frames are deleted
+	frames := append([]id3v2.Framer(nil), tag.GetFrames(id)...)
+	tag.DeleteFrames(id)
+	for _, frame := range frames {
+		if udtf, ok := frame.(id3v2.UserDefinedTextFrame); ok && remove[udtf.Description] {
+			continue
+		}
+		tag.AddFrame(id, frame)
+	}
 }
 
 // addID3Tags writes ID3v2 tags and embedded cover to an MP3 file.
-func addID3Tags(song resSongInfoData, mp3Path string, coverPath string, album resAlbum) error {
+func addID3Tags(song resSongInfoData, mp3Path string, coverPath string, album resAlbum, format string, config configuration) error {
 	var tag *id3v2.Tag
 	var err error
 
@@ -59,23 +226,38 @@ func addID3Tags(song resSongInfoData, mp3Path string, coverPath string, album re
 		tag = id3v2.NewEmptyTag()
 	}
 	defer tag.Close()
+	// v2.4 is needed for null-separated multiple values
+	tag.SetVersion(4)
 
 	title := getTitle(song)
-	artist := getArtist(song)
+	artists := getArtists(song)
 	composer := getComposer(song)
 
 	genre := getAlbumGenres(album)
 
 	tag.SetTitle(title)
 	tag.SetAlbum(song.AlbTitle)
-	tag.SetArtist(artist)
-	tag.AddTextFrame(tag.CommonID("Album artist"), tag.DefaultEncoding(), album.Artist.Name)
-	if composer != "" {
-		tag.AddTextFrame(tag.CommonID("Composer"), tag.DefaultEncoding(), composer)
+	if config.LegacyArtistTag {
+		tag.SetArtist(getArtist(song))
+		deleteUserDefinedTextFrames(tag, "ARTISTS")
+	} else {
+		tag.SetArtist(strings.Join(artists, "\x00"))
+		tag.AddUserDefinedTextFrame(id3v2.UserDefinedTextFrame{
+			Encoding:    tag.DefaultEncoding(),
+			Description: "ARTISTS",
+			Value:       strings.Join(artists, "\x00"),
+		})
 	}
-	if genre != "" {
-		tag.AddTextFrame(tag.CommonID("Content type"), tag.DefaultEncoding(), genre)
+	tag.AddTextFrame("TPE2", tag.DefaultEncoding(), getAlbumArtist(album))
+	if isCompilation(album) {
+		tag.AddTextFrame("TCMP", tag.DefaultEncoding(), "1")
+	} else {
+		tag.DeleteFrames("TCMP")
 	}
+	// Frames Deezer has no value for are removed, so that a retag does not
+	// keep stale ones
+	setID3TextFrame(tag, tag.CommonID("Composer"), composer)
+	setID3TextFrame(tag, tag.CommonID("Content type"), genre)
 	if song.TrackNumber != "" {
 		trckValue := song.TrackNumber
 		if album.NbTracks > 0 {
@@ -84,6 +266,8 @@ func addID3Tags(song resSongInfoData, mp3Path string, coverPath string, album re
 		tag.AddTextFrame(tag.CommonID("Track number/Position in set"), tag.DefaultEncoding(), trckValue)
 	} else if album.NbTracks > 0 {
 		tag.AddTextFrame(tag.CommonID("Track number/Position in set"), tag.DefaultEncoding(), strconv.Itoa(album.NbTracks))
+	} else {
+		tag.DeleteFrames(tag.CommonID("Track number/Position in set"))
 	}
 	if song.DiskNumber != "" {
 		discValue := song.DiskNumber
@@ -93,10 +277,14 @@ func addID3Tags(song resSongInfoData, mp3Path string, coverPath string, album re
 		tag.AddTextFrame(tag.CommonID("Part of a set"), tag.DefaultEncoding(), discValue)
 	} else if album.NbDiscs > 0 {
 		tag.AddTextFrame(tag.CommonID("Part of a set"), tag.DefaultEncoding(), strconv.Itoa(album.NbDiscs))
+	} else {
+		tag.DeleteFrames(tag.CommonID("Part of a set"))
 	}
-	if song.Copyright != "" {
-		tag.AddTextFrame(tag.CommonID("Copyright message"), tag.DefaultEncoding(), song.Copyright)
+	_, creditFrames := getCreditTags(song)
+	for _, frame := range []string{"TEXT", "TIPL", "TMCL"} {
+		setID3TextFrame(tag, frame, creditFrames[frame])
 	}
+	setID3TextFrame(tag, tag.CommonID("Copyright message"), song.Copyright)
 	// Prefer album release year, fallback to song physical release date
 	year := extractYear(album.ReleaseDate)
 	if year == "" {
@@ -105,8 +293,23 @@ func addID3Tags(song resSongInfoData, mp3Path string, coverPath string, album re
 	if year != "" {
 		tag.SetYear(year)
 	}
-	if song.Isrc != "" {
-		tag.AddTextFrame("TSRC", tag.DefaultEncoding(), song.Isrc)
+	setID3TextFrame(tag, "TSRC", song.Isrc)
+	// Frames from an earlier tagging go first, so that a value Deezer no
+	// longer provides is not left behind
+	txxxFields := append(replayGainFields(song, album), sourceFields(song, album, format)...)
+	var txxxKeys []string
+	for _, field := range txxxFields {
+		txxxKeys = append(txxxKeys, field.key)
+	}
+	deleteUserDefinedTextFrames(tag, txxxKeys...)
+	for _, field := range txxxFields {
+		if field.value != "" {
+			tag.AddUserDefinedTextFrame(id3v2.UserDefinedTextFrame{
+				Encoding:    tag.DefaultEncoding(),
+				Description: field.key,
+				Value:       field.value,
+			})
+		}
 	}
 
 	if _, err := os.Stat(coverPath); err == nil {
@@ -129,7 +332,7 @@ func addID3Tags(song resSongInfoData, mp3Path string, coverPath string, album re
 	return nil
 }
 
-func addTags(song resSongInfoData, path string, album resAlbum) error {
+func addTags(song resSongInfoData, path string, album resAlbum, format string, config configuration) error {
 	var err error
 
 	f, err := flac.ParseFile(path)
@@ -141,53 +344,72 @@ func addTags(song resSongInfoData, path string, album resAlbum) error {
 	if err != nil {
 		return err
 	}
-	if cmts == nil && idx > 0 {
+	if cmts == nil {
 		cmts = flacvorbis.New()
 	}
 
 	title := getTitle(song)
-	artist := getArtist(song)
 	composer := getComposer(song)
 
-	cmts.Add("TITLE", title)
-	cmts.Add("ALBUM", song.AlbTitle)
-	cmts.Add("ARTIST", artist)
-	cmts.Add("ALBUMARTIST", album.Artist.Name)
-	cmts.Add("COMPOSER", composer)
-	cmts.Add("TRACKNUMBER", song.TrackNumber)
+	setVorbisComment(cmts, "TITLE", title)
+	setVorbisComment(cmts, "ALBUM", song.AlbTitle)
+	if config.LegacyArtistTag {
+		setVorbisComment(cmts, "ARTIST", getArtist(song))
+		setVorbisComment(cmts, "ARTISTS")
+	} else {
+		// One entry per artist, main artist first
+		artists := getArtists(song)
+		setVorbisComment(cmts, "ARTIST", artists...)
+		setVorbisComment(cmts, "ARTISTS", artists...)
+	}
+	setVorbisComment(cmts, "ALBUMARTIST", getAlbumArtist(album))
+	if isCompilation(album) {
+		setVorbisComment(cmts, "COMPILATION", "1")
+	} else {
+		setVorbisComment(cmts, "COMPILATION")
+	}
+	setVorbisComment(cmts, "COMPOSER", composer)
+	creditFields, _ := getCreditTags(song)
+	for _, field := range creditVorbisFields {
+		setVorbisComment(cmts, field, creditFields[field]...)
+	}
+	// Fields without a value are removed, so that a retag does not keep
+	// stale ones
+	var trackTotal, discTotal string
 	if album.NbTracks > 0 {
-		cmts.Add("TRACKTOTAL", strconv.Itoa(album.NbTracks))
+		trackTotal = strconv.Itoa(album.NbTracks)
 	}
-	cmts.Add("DISCNUMBER", song.DiskNumber)
 	if album.NbDiscs > 0 {
-		cmts.Add("DISCTOTAL", strconv.Itoa(album.NbDiscs))
+		discTotal = strconv.Itoa(album.NbDiscs)
 	}
-	cmts.Add("COPYRIGHT", song.Copyright)
+	setVorbisComment(cmts, "TRACKNUMBER", song.TrackNumber)
+	setVorbisComment(cmts, "TRACKTOTAL", trackTotal)
+	setVorbisComment(cmts, "DISCNUMBER", song.DiskNumber)
+	setVorbisComment(cmts, "DISCTOTAL", discTotal)
+	setVorbisComment(cmts, "COPYRIGHT", song.Copyright)
 	// Add genre (from album) to Vorbis comments
-	genre := getAlbumGenres(album)
-	if genre != "" {
-		cmts.Add("GENRE", genre)
-	}
+	setVorbisComment(cmts, "GENRE", getAlbumGenres(album))
 	// Prefer album release year, fallback to song physical release date
 	year := extractYear(album.ReleaseDate)
 	if year == "" {
 		year = extractYear(song.PhysicalReleaseDate)
 	}
 	if year != "" {
-		cmts.Add("DATE", year)
+		setVorbisComment(cmts, "DATE", year)
 	} else {
 		// keep original value if no year could be extracted
-		cmts.Add("DATE", song.PhysicalReleaseDate)
+		setVorbisComment(cmts, "DATE", song.PhysicalReleaseDate)
+	}
+	setVorbisComment(cmts, "ISRC", song.Isrc)
+	for _, field := range append(replayGainFields(song, album), sourceFields(song, album, format)...) {
+		setVorbisComment(cmts, field.key, field.value)
 	}
-	cmts.Add("ISRC", song.Isrc)
 	cmtsmeta := cmts.Marshal()
-	if idx > 0 {
+	if idx >= 0 {
 		f.Meta[idx] = &cmtsmeta
 	} else {
 		f.Meta = append(f.Meta, &cmtsmeta)
 	}
 
-	f.Save(path)
-
-	return nil
+	return f.Save(path)
 }
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	id3v2 "github.com/bogem/id3v2"
+)
+
+func testSong() resSongInfoData {
+	return resSongInfoData{
+		SngId:       "3135556",
+		SngTitle:    "Harder, Better, Faster, Stronger",
+		ArtId:       "27",
+		ArtName:     "Daft Punk",
+		Artists:     []resSongInfoArtist{{ArtId: "27", ArtName: "Daft Punk"}},
+		AlbId:       "302127",
+		AlbTitle:    "Discovery",
+		TrackNumber: "4",
+		DiskNumber:  "1",
+		Isrc:        "GBDUW0000059",
+		Gain:        "-9.6",
+	}
+}
+
+func testAlbum() resAlbum {
+	return resAlbum{
+		ID:          302127,
+		Title:       "Discovery",
+		NbTracks:    14,
+		NbDiscs:     1,
+		ReleaseDate: "2001-03-07",
+		RecordType:  "album",
+		Artist:      resAlbumArtist{ID: 27, Name: "Daft Punk"},
+	}
+}
+
+// writeTestMp3 writes an untagged MP3 made of silent MPEG-1 Layer III frames
+// and a cover next to it, and returns both paths.
+func writeTestMp3(t *testing.T) (string, string) {
+	dir := t.TempDir()
+	frame := make([]byte, 417)
+	copy(frame, []byte{0xFF, 0xFB, 0x90, 0x64})
+	var audio []byte
+	for i := 0; i < 4; i++ {
+		audio = append(audio, frame...)
+	}
+	mp3Path := filepath.Join(dir, "song.mp3")
+	if err := os.WriteFile(mp3Path, audio, 0644); err != nil {
+		t.Fatal(err)
+	}
+	coverPath := filepath.Join(dir, "cover.jpg")
+	if err := os.WriteFile(coverPath, []byte{0xFF, 0xD8, 0xFF, 0xD9}, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return mp3Path, coverPath
+}
+
+func TestAddID3TagsTwice(t *testing.T) {
+	mp3Path, coverPath := writeTestMp3(t)
+	song, album := testSong(), testAlbum()
+	config := configuration{}
+
+	if err := addID3Tags(song, mp3Path, coverPath, album, "MP3_320", config); err != nil {
+		t.Fatalf("first tagging: %s", err)
+	}
+	song.SngTitle = "Harder, Better, Faster, Stronger (Remastered)"
+	if err := addID3Tags(song, mp3Path, coverPath, album, "MP3_320", config); err != nil {
+		t.Fatalf("second tagging: %s", err)
+	}
+
+	tag, err := id3v2.Open(mp3Path, id3v2.Options{Parse: true})
+	if err != nil {
+		t.Fatalf("reading the tags back: %s", err)
+	}
+	defer tag.Close()
+	if got := tag.Title(); got != song.SngTitle {
+		t.Errorf("title is %q, want %q", got, song.SngTitle)
+	}
+	if got := tag.GetTextFrame("TPE2").Text; got != "Daft Punk" {
+		t.Errorf("album artist is %q, want %q", got, "Daft Punk")
+	}
+	if n := len(tag.GetFrames(tag.CommonID("Attached picture"))); n != 1 {
+		t.Errorf("got %d covers, want 1", n)
+	}
+
+	tags := readSourceTags(mp3Path)
+	if tags.trackId != song.SngId || tags.format != "MP3_320" || tags.isrc != song.Isrc {
+		t.Errorf("source tags are %+v", tags)
+	}
+}
+
+func TestAddID3TagsRemovesStaleFrames(t *testing.T) {
+	mp3Path, coverPath := writeTestMp3(t)
+	song, album := testSong(), testAlbum()
+	song.Copyright = "(P) 2001 Daft Life Ltd."
+	if err := addID3Tags(song, mp3Path, coverPath, album, "MP3_320", configuration{}); err != nil {
+		t.Fatal(err)
+	}
+	song.Copyright = ""
+	song.Isrc = ""
+	song.Gain = ""
+	if err := addID3Tags(song, mp3Path, coverPath, album, "MP3_320", configuration{}); err != nil {
+		t.Fatal(err)
+	}
+
+	tag, err := id3v2.Open(mp3Path, id3v2.Options{Parse: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tag.Close()
+	for _, id := range []string{"TCOP", "TSRC"} {
+		if text := tag.GetTextFrame(id).Text; text != "" {
+			t.Errorf("stale %s frame %q kept", id, text)
+		}
+	}
+	for _, frame := range tag.GetFrames(tag.CommonID("User defined text information frame")) {
+		if udtf, ok := frame.(id3v2.UserDefinedTextFrame); ok && udtf.Description == "REPLAYGAIN_TRACK_GAIN" {
+			t.Errorf("stale track gain %q kept", udtf.Value)
+		}
+	}
+}
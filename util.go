@@ -2,12 +2,40 @@ package main
 
 import (
 	"fmt"
-	"path/filepath"
+	"math"
+	"path"
 	"sort"
 	"strconv"
 	"strings"
 )
 
+// parseBandwidth parses a rate such as "800k", "2M" or "1.5m" into bytes per
+// second. The k, m and g suffixes are binary multiples, as in curl and wget.
+func parseBandwidth(rate string) (int64, error) {
+	input := rate
+	rate = strings.TrimSpace(rate)
+	if rate == "" {
+		return 0, nil
+	}
+	multiplier := 1.0
+	switch strings.ToLower(rate[len(rate)-1:]) {
+	case "k":
+		multiplier = 1 << 10
+	case "m":
+		multiplier = 1 << 20
+	case "g":
+		multiplier = 1 << 30
+	}
+	if multiplier != 1 {
+		rate = rate[:len(rate)-1]
+	}
+	value, err := strconv.ParseFloat(rate, 64)
+	if err != nil || value < 0 || math.IsInf(value, 0) || math.IsNaN(value) {
+		return 0, fmt.Errorf("invalid bandwidth %q", input)
+	}
+	return int64(value * multiplier), nil
+}
+
 func getTitle(song resSongInfoData) string {
 	if song.Version != "" {
 		return strings.Join([]string{song.SngTitle, song.Version}, " ")
@@ -26,16 +54,105 @@ func getArtist(song resSongInfoData) string {
 	return fullArtist
 }
 
-func getComposer(song resSongInfoData) string {
-	if len(song.SngContributors.Data) > 0 {
-		contributors := song.SngContributors.Data[0]
-		if len(contributors.Composer) > 0 {
-			return strings.Join(contributors.Composer, ", ")
+// getArtists returns the song's artist names in Deezer's order, with the
+// main artist first and duplicates removed.
+func getArtists(song resSongInfoData) []string {
+	artists := make([]resSongInfoArtist, len(song.Artists))
+	copy(artists, song.Artists)
+	sort.SliceStable(artists, func(i, j int) bool {
+		iMain := artists[i].ArtId == song.ArtId
+		jMain := artists[j].ArtId == song.ArtId
+		if iMain != jMain {
+			return iMain
+		}
+		iOrder, errI := strconv.Atoi(artists[i].ArtistsSongsOrder)
+		jOrder, errJ := strconv.Atoi(artists[j].ArtistsSongsOrder)
+		if errI != nil || errJ != nil {
+			return false
+		}
+		return iOrder < jOrder
+	})
+
+	names := make([]string, 0, len(artists))
+	seen := make(map[string]bool)
+	for _, artist := range artists {
+		if artist.ArtName != "" && !seen[artist.ArtName] {
+			seen[artist.ArtName] = true
+			names = append(names, artist.ArtName)
+		}
+	}
+	if len(names) == 0 && song.ArtName != "" {
+		names = append(names, song.ArtName)
+	}
+	return names
+}
+
+// getCredits merges the contributor roles of every SNG_CONTRIBUTORS entry,
+// keeping each role's names in Deezer's order without duplicates.
+func getCredits(song resSongInfoData) map[string][]string {
+	credits := make(map[string][]string)
+	seen := make(map[string]bool)
+	for _, contributors := range song.SngContributors.Data {
+		for role, names := range contributors.Roles {
+			for _, name := range names {
+				key := role + "\x00" + name
+				if strings.TrimSpace(name) == "" || seen[key] {
+					continue
+				}
+				seen[key] = true
+				credits[role] = append(credits[role], name)
+			}
 		}
 	}
+	return credits
+}
+
+func getComposer(song resSongInfoData) string {
+	composers := getCredits(song)["composer"]
+	if len(composers) > 0 {
+		return strings.Join(composers, ", ")
+	}
 	return ""
 }
 
+// deezerGainReference converts Deezer's GAIN values, which are track
+// loudness figures, into ReplayGain adjustments: gain = -(GAIN + 18.4) dB.
+const deezerGainReference = 18.4
+
+// getTrackGain returns the song's REPLAYGAIN_TRACK_GAIN value, or "" when
+// Deezer gave no gain.
+func getTrackGain(song resSongInfoData) string {
+	gain, err := strconv.ParseFloat(song.Gain, 64)
+	if err != nil {
+		return ""
+	}
+	return fmt.Sprintf("%.2f dB", -(gain + deezerGainReference))
+}
+
+// getAlbumGain returns the REPLAYGAIN_ALBUM_GAIN value for an album: the
+// songs' loudness is averaged in the power domain, weighted by duration. It
+// returns "" unless every song has a gain.
+func getAlbumGain(songs []resSongInfoData) string {
+	var power, totalDuration float64
+	for _, song := range songs {
+		gain, err := strconv.ParseFloat(song.Gain, 64)
+		if err != nil {
+			return ""
+		}
+		duration, err := strconv.ParseFloat(song.Duration, 64)
+		if err != nil || duration <= 0 {
+			duration = 1
+		}
+		power += duration * math.Pow(10, gain/10)
+		totalDuration += duration
+	}
+	if totalDuration == 0 {
+		return ""
+	}
+	loudness := 10 * math.Log10(power/totalDuration)
+	return fmt.Sprintf("%.2f dB", -(loudness + deezerGainReference))
+}
+
 // extractYear returns the 4-digit year from a date string if possible.
 // It handles formats like "YYYY-MM-DD" or "YYYY" and returns an empty
 // string when a year cannot be determined.
@@ -53,6 +170,40 @@ func extractYear(dateStr string) string {
 	return ""
 }
 
+// variousArtists is the album artist Deezer and most players use for
+// compilations.
+const variousArtists = "Various Artists"
+
+// isCompilation reports whether album is a compilation: Deezer says so in
+// record_type, its artist is "Various Artists", or most of its tracks are by
+// other artists than the album artist.
+func isCompilation(album resAlbum) bool {
+	if album.RecordType == "compile" || strings.EqualFold(album.Artist.Name, variousArtists) {
+		return true
+	}
+	if len(album.Tracks.Data) < 3 {
+		return false
+	}
+	artists := make(map[int]bool)
+	byAlbumArtist := 0
+	for _, track := range album.Tracks.Data {
+		artists[track.Artist.ID] = true
+		if track.Artist.ID == album.Artist.ID {
+			byAlbumArtist++
+		}
+	}
+	return len(artists) > 1 && byAlbumArtist*2 < len(album.Tracks.Data)
+}
+
+// getAlbumArtist returns the ALBUMARTIST of album: "Various Artists" for a
+// compilation, so that players keep it together, and its artist otherwise.
+func getAlbumArtist(album resAlbum) string {
+	if isCompilation(album) {
+		return variousArtists
+	}
+	return album.Artist.Name
+}
+
 // getAlbumGenres returns a comma-separated list of genre names from the album.
 // Falls back to album.Label if no genre entries are present.
 func getAlbumGenres(album resAlbum) string {
@@ -73,37 +224,53 @@ func getAlbumGenres(album resAlbum) string {
 	return ""
 }
 
-func SanitizePath(rawPath string) string {
-	cleanPath := filepath.Clean(rawPath)
-	replacements := map[string]string{
-		"<":  "-",
-		">":  "-",
-		":":  "-",
-		"\"": "-",
-		"/":  "-",
-		"\\": "-",
-		"|":  "-",
-		"?":  "-",
-		"*":  "-",
-	}
-	for old, new := range replacements {
-		cleanPath = strings.ReplaceAll(cleanPath, old, new)
-	}
-	return cleanPath
-}
-
-func getSongPath(song resSongInfoData, album resAlbum, config configuration, format string) string {
-	trackNum, err := strconv.Atoi(song.TrackNumber)
-	cleanArtist := SanitizePath(album.Artist.Name)
-	cleanAlbumTitle := SanitizePath(song.AlbTitle)
-	cleanSongTitle := SanitizePath(song.SngTitle)
+// expectedSize returns the file size Deezer declares for song in format, or
+// zero when it is not known.
+func expectedSize(song resSongInfoData, format string) int64 {
+	var size string
+	switch strings.ToUpper(format) {
+	case "FLAC":
+		size = song.FilesizeFlac
+	case "MP3_320":
+		size = song.FilesizeMp3320
+	case "MP3_256":
+		size = song.FilesizeMp3256
+	case "MP3_128":
+		size = song.FilesizeMp3128
+	}
+	n, err := strconv.ParseInt(size, 10, 64)
 	if err != nil {
-		panic(err)
+		return 0
 	}
+	return n
+}
+
+// getSongPath returns where song is saved: dest's path, or dest's template
+// under the destination directory. Discs of a multi-disc album are kept apart as
+// configured by multi_disc, except in folders shared by many albums.
+func getSongPath(song resSongInfoData, album resAlbum, config configuration, dest songDestination, format string) string {
 	ext := "flac"
 	if strings.HasPrefix(strings.ToUpper(format), "MP3") {
 		ext = "mp3"
 	}
-	return fmt.Sprintf("%s/%s/%s - %s/%02d - %s.%s", config.DestDir,
-		cleanArtist, cleanArtist, cleanAlbumTitle, trackNum, cleanSongTitle, ext)
+	if dest.path != "" {
+		return strings.TrimSuffix(dest.path, path.Ext(dest.path)) + "." + ext
+	}
+
+	template := dest.template
+	fields := songPathFields(song, album, format)
+	for name, value := range dest.fields {
+		fields[name] = value
+	}
+	if strings.Contains(template, "{version") {
+		fields["title"] = song.SngTitle
+	}
+	relPath := expandPathTemplate(template, fields, config)
+	if relPath == "" || strings.HasSuffix(template, "/") {
+		relPath = path.Join(relPath, song.SngId)
+	}
+	if album.NbDiscs > 1 && !strings.Contains(template, "{disc") && !dest.mixedAlbums {
+		relPath = applyDiscLayout(relPath, config.MultiDisc, fields["disc"])
+	}
+	return fmt.Sprintf("%s/%s.%s", config.DestDir, relPath, ext)
 }
@@ -0,0 +1,37 @@
+package main
+
+import "testing"
+
+func TestParseBandwidth(t *testing.T) {
+	tests := []struct {
+		rate string
+		want int64
+	}{
+		{"", 0},
+		{"  ", 0},
+		{"0", 0},
+		{"1500", 1500},
+		{"800k", 800 << 10},
+		{"800K", 800 << 10},
+		{"2M", 2 << 20},
+		{"1.5m", 3 << 19},
+		{"1g", 1 << 30},
+		{" 64k ", 64 << 10},
+	}
+	for _, test := range tests {
+		got, err := parseBandwidth(test.rate)
+		if err != nil {
+			t.Errorf("parseBandwidth(%q): %s", test.rate, err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("parseBandwidth(%q) = %d, want %d", test.rate, got, test.want)
+		}
+	}
+
+	for _, rate := range []string{"k", "fast", "-1M", "2MB", "inf", "NaN"} {
+		if got, err := parseBandwidth(rate); err == nil {
+			t.Errorf("parseBandwidth(%q) = %d, want an error", rate, got)
+		}
+	}
+}
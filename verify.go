@@ -0,0 +1,271 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	id3v2 "github.com/bogem/id3v2"
+	"github.com/go-flac/go-flac"
+)
+
+// Kinds of problem the verify command reports.
+const (
+	problemBroken     = "broken"
+	problemUntagged   = "untagged"
+	problemMismatched = "mismatched"
+)
+
+type verifyProblem struct {
+	kind   string
+	path   string
+	reason string
+}
+
+// requiredVorbisTags are the Vorbis comments every downloaded FLAC gets.
+var requiredVorbisTags = []string{"TITLE", "ARTIST", "ALBUM", "TRACKNUMBER"}
+
+// checkFlacFile parses a FLAC, walks its frames and checks its tags and
+// embedded cover.
+func checkFlacFile(path string) []verifyProblem {
+	f, err := flac.ParseFile(path)
+	if err != nil {
+		return []verifyProblem{{problemBroken, path, err.Error()}}
+	}
+	if err := verifyFlacFrames(f); err != nil {
+		return []verifyProblem{{problemBroken, path, err.Error()}}
+	}
+
+	var problems []verifyProblem
+	cmts, _, err := extractFlacComment(f)
+	if err != nil {
+		return []verifyProblem{{problemBroken, path, err.Error()}}
+	}
+	var missing []string
+	for _, key := range requiredVorbisTags {
+		var values []string
+		if cmts != nil {
+			values, _ = cmts.Get(key)
+		}
+		if len(values) == 0 || values[0] == "" {
+			missing = append(missing, key)
+		}
+	}
+	if len(missing) > 0 {
+		problems = append(problems, verifyProblem{problemUntagged, path, "missing " + strings.Join(missing, ", ")})
+	}
+
+	hasCover := false
+	for _, meta := range f.Meta {
+		if meta.Type == flac.Picture {
+			hasCover = true
+		}
+	}
+	if !hasCover {
+		problems = append(problems, verifyProblem{problemUntagged, path, "no embedded cover"})
+	}
+	return problems
+}
+
+// checkMp3File parses an MP3's ID3v2 tag and checks its frames and embedded
+// cover.
+func checkMp3File(path string) []verifyProblem {
+	tag, err := id3v2.Open(path, id3v2.Options{Parse: true})
+	if err != nil {
+		return []verifyProblem{{problemBroken, path, err.Error()}}
+	}
+	defer tag.Close()
+
+	var problems []verifyProblem
+	var missing []string
+	if tag.Title() == "" {
+		missing = append(missing, "title")
+	}
+	if tag.Artist() == "" {
+		missing = append(missing, "artist")
+	}
+	if tag.Album() == "" {
+		missing = append(missing, "album")
+	}
+	if tag.GetTextFrame(tag.CommonID("Track number/Position in set")).Text == "" {
+		missing = append(missing, "track number")
+	}
+	if len(missing) > 0 {
+		problems = append(problems, verifyProblem{problemUntagged, path, "missing " + strings.Join(missing, ", ")})
+	}
+	if len(tag.GetFrames(tag.CommonID("Attached picture"))) == 0 {
+		problems = append(problems, verifyProblem{problemUntagged, path, "no embedded cover"})
+	}
+	return problems
+}
+
+// checkRecordedFile compares a file against the size and checksum recorded
+// in its folder's manifest when it was downloaded.
+func checkRecordedFile(path string, entry manifestEntry) []verifyProblem {
+	size, sum, err := fileChecksum(path)
+	if err != nil {
+		return []verifyProblem{{problemBroken, path, err.Error()}}
+	}
+	if size != entry.Size {
+		return []verifyProblem{{problemMismatched, path, fmt.Sprintf("size is %d bytes, recorded %d", size, entry.Size)}}
+	}
+	if sum != entry.Sha256 {
+		return []verifyProblem{{problemMismatched, path, "checksum differs from the recorded one"}}
+	}
+	return nil
+}
+
+// processVerify walks the library, or the folder given as argument, and
+// reports broken, untagged and mismatched files. With --redownload, files
+// with problems are downloaded again by the Deezer ID recorded in their
+// manifest or, failing that, their DEEZER_TRACKID tag.
+func processVerify(args []string, config configuration, logFile *os.File) {
+	flags := flag.NewFlagSet("verify", flag.ContinueOnError)
+	flags.Usage = printUsage
+	redownload := flags.Bool("redownload", false, "")
+	if err := flags.Parse(args); err != nil {
+		return
+	}
+	root := config.DestDir
+	if flags.NArg() > 0 {
+		root = flags.Arg(0)
+	}
+
+	var problems []verifyProblem
+	trackIds := make(map[string]string)
+	manifests := make(map[string]dirManifest)
+	checked := 0
+	unrecorded := 0
+
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		ext := strings.ToLower(filepath.Ext(path))
+		if d.IsDir() || (ext != ".flac" && ext != ".mp3") {
+			return nil
+		}
+		checked++
+
+		dir := filepath.Dir(path)
+		manifest, ok := manifests[dir]
+		if !ok {
+			manifest, err = readManifest(dir)
+			if err != nil {
+				log.Printf("error reading manifest in %s: %s\n", dir, err)
+				manifest = make(dirManifest)
+			}
+			manifests[dir] = manifest
+		}
+
+		var fileProblems []verifyProblem
+		if ext == ".flac" {
+			fileProblems = checkFlacFile(path)
+		} else {
+			fileProblems = checkMp3File(path)
+		}
+		if entry, ok := manifest[filepath.Base(path)]; ok {
+			fileProblems = append(fileProblems, checkRecordedFile(path, entry)...)
+			trackIds[path] = entry.TrackId
+		} else {
+			unrecorded++
+		}
+
+		for _, problem := range fileProblems {
+			msg := fmt.Sprintf("%-10s %s: %s\n", problem.kind, problem.path, problem.reason)
+			log.Print(msg)
+			logFile.Write([]byte(msg))
+		}
+		problems = append(problems, fileProblems...)
+		return nil
+	})
+	if err != nil {
+		log.Fatalf("error walking %s: %s\n", root, err)
+	}
+
+	counts := make(map[string]int)
+	seen := make(map[string]bool)
+	var toRedownload []string
+	for _, problem := range problems {
+		counts[problem.kind]++
+		if !seen[problem.path] {
+			seen[problem.path] = true
+			toRedownload = append(toRedownload, problem.path)
+		}
+	}
+	msg := fmt.Sprintf("Checked %d files: %d broken, %d untagged, %d mismatched, %d not in a manifest\n",
+		checked, counts[problemBroken], counts[problemUntagged], counts[problemMismatched], unrecorded)
+	log.Print(msg)
+	logFile.Write([]byte(msg))
+
+	if !*redownload || len(toRedownload) == 0 {
+		return
+	}
+
+	batch := newBatchProgress(len(toRedownload))
+	for i, path := range toRedownload {
+		trackId := trackIds[path]
+		if trackId == "" {
+			// Files from before manifests, or whose folder was moved
+			trackId = readSourceTags(path).trackId
+		}
+		if trackId == "" {
+			log.Printf("Cannot redownload %s: no Deezer track ID recorded or tagged\n", path)
+			continue
+		}
+		newPath, err := redownloadTrack(path, trackId, config, batch, i+1)
+		if err != nil {
+			msg := fmt.Sprintf("Redownload failed: %s: %s\n", path, err)
+			log.Print(msg)
+			logFile.Write([]byte(msg))
+			continue
+		}
+		// Only the extension can differ, when the song is no longer
+		// available in its original format
+		if newPath != path {
+			os.Remove(path)
+			forgetInManifest(path)
+		}
+		msg := fmt.Sprintf("Redownloaded: %s\n", newPath)
+		log.Print(msg)
+		logFile.Write([]byte(msg))
+	}
+}
+
+// redownloadTrack fetches a song again by its Deezer track ID into songPath,
+// where it was saved before, so that playlists listing it keep working.
+func redownloadTrack(songPath string, trackId string, config configuration, batch *batchProgress, position int) (string, error) {
+	var id int64
+	if _, err := fmt.Sscan(trackId, &id); err != nil {
+		return "", fmt.Errorf("invalid track ID %q", trackId)
+	}
+	songInfo, err := getSongInfo(id, config)
+	if err != nil {
+		return "", err
+	}
+	song := songInfo.Data
+
+	var album resAlbum
+	err = retryOnQuota(func() error {
+		var err error
+		album, err = getAlbum(song.AlbId, config)
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+	err = loadAlbumDetails(&album, config)
+	if err != nil {
+		return "", err
+	}
+	manifest, err := readManifest(filepath.Dir(songPath))
+	if err != nil {
+		return "", err
+	}
+	dest := songDestination{path: songPath, mixedAlbums: mixedAlbumDir(manifest)}
+	return downloadTrack(song, album, config, dest, batch, position)
+}
@@ -0,0 +1,26 @@
+package main
+
+import "testing"
+
+func TestCheckMp3File(t *testing.T) {
+	mp3Path, coverPath := writeTestMp3(t)
+	if err := addID3Tags(testSong(), mp3Path, coverPath, testAlbum(), "MP3_320", configuration{}); err != nil {
+		t.Fatal(err)
+	}
+	if problems := checkMp3File(mp3Path); len(problems) > 0 {
+		t.Errorf("tagged MP3 reported: %+v", problems)
+	}
+}
+
+func TestCheckMp3FileUntagged(t *testing.T) {
+	mp3Path, _ := writeTestMp3(t)
+	problems := checkMp3File(mp3Path)
+	if len(problems) != 2 {
+		t.Fatalf("got %+v, want missing tags and no cover", problems)
+	}
+	for _, problem := range problems {
+		if problem.kind != problemUntagged {
+			t.Errorf("got a %s problem, want %s: %s", problem.kind, problemUntagged, problem.reason)
+		}
+	}
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// watchStateName is the file in dest_dir where the watch command remembers
+// the albums it has seen of each followed artist. Followed playlists and
+// favorites keep a playlist sync state instead.
+const watchStateName = ".deezer-watch.json"
+
+// favoritesSyncId names the sync state of the account's favorite tracks.
+const favoritesSyncId = "favorites"
+
+type watchState struct {
+	// Artists maps a followed artist's ID to the IDs of its albums that were
+	// downloaded or already there when the artist was first polled.
+	Artists  map[string][]string `json:"artists"`
+	LastPoll time.Time           `json:"last_poll"`
+}
+
+func readWatchState(config configuration) (watchState, error) {
+	state := watchState{Artists: make(map[string][]string)}
+	data, err := os.ReadFile(filepath.Join(config.DestDir, watchStateName))
+	if errors.Is(err, os.ErrNotExist) {
+		return state, nil
+	}
+	if err != nil {
+		return state, err
+	}
+	err = json.Unmarshal(data, &state)
+	if state.Artists == nil {
+		state.Artists = make(map[string][]string)
+	}
+	return state, err
+}
+
+func writeWatchState(state watchState, config configuration) error {
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(config.DestDir, watchStateName), data, 0644)
+}
+
+// processWatch polls the playlists, artists and favorites listed under
+// [watch] every interval_minutes, downloading what is new, until it is
+// stopped. SIGHUP reloads the list from the config file and polls at once.
+// Failures are logged and retried on the next poll rather than ending the
+// program.
+func processWatch(config configuration, logFile *os.File) {
+	state, err := readWatchState(config)
+	if err != nil {
+		log.Fatalf("error reading %s: %s\n", watchStateName, err)
+	}
+
+	reload := make(chan os.Signal, 1)
+	signal.Notify(reload, syscall.SIGHUP)
+
+	for {
+		pollWatched(config, &state, logFile)
+		clearCoverCache()
+		state.LastPoll = time.Now()
+		err = writeWatchState(state, config)
+		if err != nil {
+			msg := fmt.Sprintf("error writing %s: %s\n", watchStateName, err)
+			log.Print(msg)
+			logFile.Write([]byte(msg))
+		}
+
+		interval := time.Duration(config.Watch.IntervalMinutes * float64(time.Minute))
+		log.Printf("Next poll in %s\n", interval)
+		select {
+		case <-time.After(interval):
+		case <-reload:
+			newConfig, err := getConfig()
+			if err != nil {
+				log.Printf("error reloading config, keeping the current watch list: %s\n", err)
+				continue
+			}
+			config.Watch = newConfig.Watch
+			log.Printf("Reloaded watch list: %d playlists, %d artists\n",
+				len(config.Watch.Playlists), len(config.Watch.Artists))
+		}
+	}
+}
+
+// pollWatched downloads what is new in every followed playlist, artist and
+// the favorites.
+func pollWatched(config configuration, state *watchState, logFile *os.File) {
+	watch := config.Watch
+	for idx, playlistId := range watch.Playlists {
+		log.Printf("[%03d/%03d] Syncing playlist %s\n", idx+1, len(watch.Playlists), playlistId)
+		err := syncPlaylist(playlistId, config, logFile)
+		if err != nil {
+			logWatchError("playlist "+playlistId, err, logFile)
+		}
+	}
+
+	for idx, artistId := range watch.Artists {
+		log.Printf("[%03d/%03d] Checking artist %s for new albums\n", idx+1, len(watch.Artists), artistId)
+		err := pollArtist(artistId, config, state, logFile)
+		if err != nil {
+			logWatchError("artist "+artistId, err, logFile)
+		}
+	}
+
+	if watch.Favorites {
+		log.Println("Syncing favorite tracks")
+		err := syncFavorites(config, logFile)
+		if err != nil {
+			logWatchError("favorites", err, logFile)
+		}
+	}
+}
+
+func logWatchError(what string, err error, logFile *os.File) {
+	msg := fmt.Sprintf("error watching %s: %s%s\n", what, err, errorHint(err))
+	log.Print(msg)
+	logFile.Write([]byte(msg))
+}
+
+// pollArtist downloads the albums of an artist that were not seen before.
+// The first time an artist is polled its existing albums are only recorded,
+// unless artist_backfill is set.
+func pollArtist(artistId string, config configuration, state *watchState, logFile *os.File) error {
+	var albums resArtistAlbums
+	err := retryOnQuota(func() error {
+		var err error
+		albums, err = getArtistAlbums(artistId, config)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("error getting artist albums: %w", err)
+	}
+
+	seenIds, followed := state.Artists[artistId]
+	seen := make(map[string]bool)
+	for _, albumId := range seenIds {
+		seen[albumId] = true
+	}
+	if !followed && !config.Watch.ArtistBackfill {
+		for _, album := range albums.Data {
+			seenIds = append(seenIds, strconv.Itoa(album.ID))
+		}
+		state.Artists[artistId] = seenIds
+		log.Printf("Following artist %s: %d existing albums recorded, new ones will be downloaded\n",
+			artistId, len(albums.Data))
+		return nil
+	}
+
+	for _, album := range albums.Data {
+		albumId := strconv.Itoa(album.ID)
+		if seen[albumId] {
+			continue
+		}
+		log.Printf("New album from artist %s: %s (%s)\n", artistId, album.Title, albumId)
+		// Albums that failed with an error are tried again on the next poll.
+		// One that is unavailable, or has a track in no available format, is
+		// not: its other tracks would be downloaded again every time
+		downloaded, err := downloadAlbum(albumId, config, logFile)
+		if err != nil {
+			logWatchError("album "+albumId, err, logFile)
+			continue
+		}
+		if !downloaded {
+			msg := fmt.Sprintf("Album %s from artist %s is incomplete and will not be tried again\n", albumId, artistId)
+			log.Print(msg)
+			logFile.Write([]byte(msg))
+		}
+		seen[albumId] = true
+		seenIds = append(seenIds, albumId)
+	}
+	if seenIds == nil {
+		seenIds = []string{}
+	}
+	state.Artists[artistId] = seenIds
+	return nil
+}
+
+// syncFavorites syncs the account's favorite tracks like a playlist named
+// "Favorites".
+func syncFavorites(config configuration, logFile *os.File) error {
+	userData, err := getUserData(config)
+	if err != nil {
+		return fmt.Errorf("error getting user data: %w", err)
+	}
+	userId := userData.Results.User.UserId
+	if userId == 0 {
+		return errors.New("the ARL in the config file has expired or is invalid")
+	}
+
+	var tracks resTracks
+	err = retryOnQuota(func() error {
+		var err error
+		tracks, err = getFavorites(strconv.Itoa(userId), config)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("error getting favorite tracks: %w", err)
+	}
+	return syncTracks(favoritesSyncId, resPlaylist{Title: "Favorites"}, tracks, config, logFile)
+}